@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore 課題ファイルの保存先。複数台のアプリケーションサーバで共有できるようS3互換ストレージも選べる
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Open 存在しない場合はErrBlobNotFoundを返す
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// Delete 存在しない場合もエラーにしない
+	Delete(ctx context.Context, key string) error
+	// Clear 全てのファイルを削除する
+	Clear(ctx context.Context) error
+}
+
+// newBlobStoreFromEnv BLOB_STORE=s3 の場合はS3互換ストレージ、それ以外はAssignmentsDirectoryを使う
+func newBlobStoreFromEnv() BlobStore {
+	if GetEnv("BLOB_STORE", "local") == "s3" {
+		return NewS3BlobStore(
+			GetEnv("S3_ENDPOINT", "http://127.0.0.1:9000"),
+			GetEnv("S3_REGION", "us-east-1"),
+			GetEnv("S3_BUCKET", "isucholar"),
+			GetEnv("S3_ACCESS_KEY_ID", ""),
+			GetEnv("S3_SECRET_ACCESS_KEY", ""),
+		)
+	}
+	return NewLocalBlobStore(AssignmentsDirectory)
+}
+
+// restoreInitialBlobs 初期データのファイルを全てBlobStoreに登録し直す
+func restoreInitialBlobs(ctx context.Context, store BlobStore, dir string) error {
+	if err := store.Clear(ctx); err != nil {
+		return err
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		key, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return store.Put(ctx, filepath.ToSlash(key), f, info.Size())
+	})
+}
+
+type LocalBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) *LocalBlobStore {
+	return &LocalBlobStore{dir: dir}
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, filepath.Clean(s.dir)+string(filepath.Separator)) {
+		return "", errors.New("invalid blob key: " + key)
+	}
+	return path, nil
+}
+
+func (s *LocalBlobStore) Put(_ context.Context, key string, r io.Reader, _ int64) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return err
+	}
+	// 書き込み途中のファイルを読まれないよう、一時ファイルに書いてからrenameする
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o666); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalBlobStore) Open(_ context.Context, key string) (io.ReadSeekCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *LocalBlobStore) Delete(_ context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) Clear(_ context.Context) error {
+	if err := os.RemoveAll(s.dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(s.dir, 0o777)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3BlobStore S3互換ストレージ(MinIOなど)。バケットはパス形式(endpoint/bucket/key)で指定する
+type S3BlobStore struct {
+	endpoint        *url.URL
+	region          string
+	bucket          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+func NewS3BlobStore(endpoint, region, bucket, accessKeyID, secretAccessKey string) *S3BlobStore {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		panic(fmt.Errorf("invalid S3_ENDPOINT: %w", err))
+	}
+	return &S3BlobStore{
+		endpoint:        u,
+		region:          region,
+		bucket:          bucket,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		client:          &http.Client{},
+	}
+}
+
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+func (s *S3BlobStore) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = ""
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do SigV4で署名してリクエストを送る。本文はストリーミングするので署名に含めない
+func (s *S3BlobStore) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u := s.objectURL(key, query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+func (s *S3BlobStore) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + s3UnsignedPayload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", s.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3URIEncode RFC 3986の非予約文字以外をエンコードする
+func s3URIEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			sb.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func s3Error(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("s3: %v %v: %v", res.Request.Method, res.Status, string(body))
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	res, err := s.do(ctx, http.MethodPut, key, nil, r, size, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	res, err := s.do(ctx, http.MethodHead, key, nil, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, s3Error(res)
+	}
+	return &s3Object{ctx: ctx, store: s, key: key, size: res.ContentLength}, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3Error(res)
+	}
+	return nil
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3BlobStore) Clear(ctx context.Context) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := s.do(ctx, http.MethodGet, "", query, nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			err := s3Error(res)
+			res.Body.Close()
+			return err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, content := range result.Contents {
+			if err := s.Delete(ctx, content.Key); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// s3Object 読み込み位置からのRange付きGETで内容を読む。Seekした場合は次のReadでリクエストし直す
+type s3Object struct {
+	ctx    context.Context
+	store  *S3BlobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		res, err := o.store.do(o.ctx, http.MethodGet, o.key, nil, nil, 0, header)
+		if err != nil {
+			return 0, err
+		}
+		if res.StatusCode != http.StatusPartialContent && res.StatusCode != http.StatusOK {
+			err := s3Error(res)
+			res.Body.Close()
+			return 0, err
+		}
+		o.body = res.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	if errors.Is(err, io.EOF) && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.offset + offset
+	case io.SeekEnd:
+		abs = o.size + offset
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if abs != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = abs
+	return abs, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
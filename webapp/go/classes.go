@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+// nullable JSONでフィールドの省略とnullを区別する。省略された場合はSetがfalse
+type nullable[T any] struct {
+	Set   bool
+	Value *T
+}
+
+func (n *nullable[T]) UnmarshalJSON(data []byte) error {
+	n.Set = true
+	if string(data) == "null" {
+		n.Value = nil
+		return nil
+	}
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	n.Value = &v
+	return nil
+}
+
+type UpdateClassRequest struct {
+	Part              *uint8              `json:"part"`
+	Title             *string             `json:"title"`
+	Description       *string             `json:"description"`
+	DueAt             nullable[time.Time] `json:"due_at"` // nullの場合は締切をなくす
+	LatePolicy        *LatePolicy         `json:"late_policy"`
+	LatePenaltyPerDay *int                `json:"late_penalty_per_day"`
+	LateDays          *int                `json:"late_days"`
+	AllowedTypes      []string            `json:"allowed_types"`
+}
+
+// UpdateClass PATCH /api/courses/:courseID/classes/:classID 講義の編集
+func (h *handlers) UpdateClass(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	var req UpdateClassRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if req.Part != nil && *req.Part == 0 {
+		return c.String(http.StatusBadRequest, "Invalid part.")
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var class Class
+	if err := tx.GetContext(ctx, &class, "SELECT * FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR UPDATE", classID, courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such class.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if req.Part != nil {
+		class.Part = *req.Part
+	}
+	if req.Title != nil {
+		class.Title = *req.Title
+	}
+	if req.Description != nil {
+		class.Description = *req.Description
+	}
+	if req.DueAt.Set {
+		class.DueAt = req.DueAt.Value
+	}
+	if req.LatePolicy != nil {
+		class.LatePolicy = *req.LatePolicy
+	}
+	if req.LatePenaltyPerDay != nil {
+		class.LatePenaltyPerDay = *req.LatePenaltyPerDay
+	}
+	if req.LateDays != nil {
+		class.LateDays = *req.LateDays
+	}
+	if message := validateLatePolicy(class.LatePolicy, class.LatePenaltyPerDay, class.LateDays); message != "" {
+		return c.String(http.StatusBadRequest, message)
+	}
+	if req.AllowedTypes != nil {
+		if message := validateAllowedTypes(req.AllowedTypes); message != "" {
+			return c.String(http.StatusBadRequest, message)
+		}
+		class.AllowedTypes = strings.Join(lo.Uniq(req.AllowedTypes), ",")
+	}
+
+	// 締切を変えた場合は提出の受付状況も新しい締切に合わせる (締切の延長・削除で再び提出できるようになる)。
+	// 教員が CloseSubmissions で締め切った講義は締切を変えても再開しない
+	wasClosed := class.SubmissionClosed
+	if !class.ClosedManually && (req.DueAt.Set || req.LatePolicy != nil || req.LateDays != nil) {
+		closesAt := class.closesAt()
+		class.SubmissionClosed = closesAt != nil && !closesAt.After(time.Now())
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE `classes` SET `part` = ?, `title` = ?, `description` = ?, `due_at` = ?, `late_policy` = ?, `late_penalty_per_day` = ?, `late_days` = ?, `allowed_types` = ?, `submission_closed` = ? WHERE `id` = ?",
+		class.Part, class.Title, class.Description, class.DueAt, class.LatePolicy, class.LatePenaltyPerDay, class.LateDays, class.AllowedTypes, class.SubmissionClosed, classID); err != nil {
+		if pgxIsDuplicateError(err) {
+			return c.String(http.StatusConflict, "A class with the same part already exists.")
+		}
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if class.SubmissionClosed && !wasClosed {
+		if err := enqueueSimilarityAnalysis(ctx, classID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ReorderClasses PUT /api/courses/:courseID/classes/order 講義の並び替え
+// 科目の全ての講義のIDを新しい順番で指定し、partを1から振り直す
+func (h *handlers) ReorderClasses(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var req []string
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var classIDs []string
+	if err := tx.SelectContext(ctx, &classIDs, "SELECT `id` FROM `classes` WHERE `course_id` = ? ORDER BY `part` FOR UPDATE", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if len(req) != len(classIDs) || len(lo.Uniq(req)) != len(req) || len(lo.Intersect(classIDs, req)) != len(classIDs) {
+		return c.String(http.StatusBadRequest, "All classes of the course must be specified exactly once.")
+	}
+
+	// UNIQUE(course_id, part)に違反しないよう、一度全てのpartを負の値に退避してから振り直す
+	if _, err := tx.ExecContext(ctx, "UPDATE `classes` SET `part` = -`part` WHERE `course_id` = ?", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for i, classID := range req {
+		if _, err := tx.ExecContext(ctx, "UPDATE `classes` SET `part` = ? WHERE `id` = ?", i+1, classID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type classSubmission struct {
+	UserID string        `db:"user_id"`
+	Score  sql.NullInt16 `db:"score"`
+}
+
+// DeleteClass DELETE /api/courses/:courseID/classes/:classID 講義の削除
+// 採点済みの提出がある講義は force=true を指定した場合のみ削除できる
+func (h *handlers) DeleteClass(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+	force, _ := strconv.ParseBool(c.QueryParam("force"))
+
+	ctx := c.Request().Context()
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var class Class
+	if err := tx.GetContext(ctx, &class, "SELECT * FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR UPDATE", classID, courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such class.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var submissions []classSubmission
+	if err := tx.SelectContext(ctx, &submissions, "SELECT `user_id`, `score` FROM `submissions` WHERE `class_id` = ? FOR UPDATE", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	graded := lo.Filter(submissions, func(s classSubmission, _ int) bool {
+		return s.Score.Valid
+	})
+	if len(graded) > 0 && !force {
+		return c.String(http.StatusConflict, "This class has graded submissions.")
+	}
+
+	var storageKeys []string
+	if err := tx.SelectContext(ctx, &storageKeys, "SELECT `storage_key` FROM `submission_versions` WHERE `class_id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM `criterion_scores` WHERE `class_id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM `rubric_criteria` WHERE `class_id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM `submission_similarities` WHERE `class_id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM `similarity_analyses` WHERE `class_id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM `submission_versions` WHERE `class_id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM `submissions` WHERE `class_id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM `classes` WHERE `id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 提出者数と、削除した講義の点数を含む合計点のキャッシュを合わせる。
+	// 削除自体は完了しているので失敗してもエラーにはせず、合計点のずれは reconcile-scores で直す
+	if err := rdb.Del(ctx, "submissions:"+classID).Err(); err != nil {
+		c.Logger().Error(err)
+	}
+	deltas := make(map[string]int, len(graded))
+	for _, s := range graded {
+		deltas[s.UserID] -= int(s.Score.Int16)
+	}
+	if err := applyCourseTotalScoreDeltas(ctx, courseID, deltas); err != nil {
+		c.Logger().Error(err)
+	}
+
+	if err := removeClassFiles(ctx, h.Blobs, classID, storageKeys); err != nil {
+		c.Logger().Error(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// classZipBlobKey 一括ダウンロード用に以前作っていた講義の課題のzip
+func classZipBlobKey(classID string) string {
+	return classID + ".zip"
+}
+
+// removeClassFiles 講義の提出ファイルと課題のzipを削除する。DBの削除後に呼ぶので失敗しても処理は続ける
+func removeClassFiles(ctx context.Context, blobs BlobStore, classID string, storageKeys []string) error {
+	var errs []error
+	for _, key := range append(storageKeys, classZipBlobKey(classID)) {
+		if err := blobs.Delete(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
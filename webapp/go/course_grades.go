@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+// histogramBuckets 合計点の分布を満点の10%刻みで集計する
+const histogramBuckets = 10
+
+type HistogramBucket struct {
+	Min   int `json:"min"`
+	Max   int `json:"max"` // この値を含む
+	Count int `json:"count"`
+}
+
+type ScoreStats struct {
+	Count  int     `json:"count"`
+	Avg    float64 `json:"avg"`
+	StdDev float64 `json:"std_dev"`
+	Max    int     `json:"max"`
+	Min    int     `json:"min"`
+	Median float64 `json:"median"`
+	P25    float64 `json:"p25"`
+	P75    float64 `json:"p75"`
+	P90    float64 `json:"p90"`
+}
+
+func newScoreStats(scores []int) ScoreStats {
+	avg := averageInt(scores, 0)
+	return ScoreStats{
+		Count:  len(scores),
+		Avg:    avg,
+		StdDev: stdDevInt(scores, avg),
+		Max:    maxInt(scores, 0),
+		Min:    minInt(scores, 0),
+		Median: medianInt(scores, 0),
+		P25:    percentileInt(scores, 25, 0),
+		P75:    percentileInt(scores, 75, 0),
+		P90:    percentileInt(scores, 90, 0),
+	}
+}
+
+type ClassGradeStats struct {
+	ClassID        string     `json:"class_id"`
+	Part           uint8      `json:"part"`
+	Title          string     `json:"title"`
+	Submitters     int        `json:"submitters"`
+	SubmissionRate float64    `json:"submission_rate"` // 履修者に対する提出者の割合
+	Scores         ScoreStats `json:"scores"`          // 採点済みの提出のみ
+}
+
+type StudentGrade struct {
+	Code             string  `json:"code"`
+	Name             string  `json:"name"`
+	ClassScores      []*int  `json:"class_scores"` // classesと同じ順。未採点はnull
+	TotalScore       int     `json:"total_score"`
+	TotalScoreTScore float64 `json:"total_score_t_score"` // 偏差値
+}
+
+type GetCourseGradesResponse struct {
+	TotalScores ScoreStats        `json:"total_scores"`
+	Histogram   []HistogramBucket `json:"histogram"`
+	Classes     []ClassGradeStats `json:"classes"`
+	Students    []StudentGrade    `json:"students"`
+}
+
+// GetCourseGrades GET /api/courses/:courseID/grades 科目の履修者全員の成績と統計
+// 合計点は学生の成績照会と同じくRedisの合計点を使う
+func (h *handlers) GetCourseGrades(c echo.Context) error {
+	courseID := c.Param("courseID")
+	ctx := c.Request().Context()
+
+	gradebook, err := buildGradebook(ctx, h.DB, courseID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such course.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	totals, err := getCourseTotalScores(ctx, courseID, lo.Map(gradebook.Rows, func(row GradebookRow, _ int) string {
+		return row.UserID
+	}))
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	students := make([]StudentGrade, 0, len(gradebook.Rows))
+	for i, row := range gradebook.Rows {
+		students = append(students, StudentGrade{
+			Code:             row.UserCode,
+			Name:             row.Name,
+			ClassScores:      row.Scores,
+			TotalScore:       totals[i],
+			TotalScoreTScore: tScoreInt(totals[i], totals),
+		})
+	}
+
+	type classSubmitters struct {
+		ClassID    string `db:"class_id"`
+		Submitters int    `db:"submitters"`
+	}
+	var submitters []classSubmitters
+	query := "SELECT `submissions`.`class_id`, COUNT(*) AS `submitters`" +
+		" FROM `submissions`" +
+		" JOIN `classes` ON `classes`.`id` = `submissions`.`class_id`" +
+		" WHERE `classes`.`course_id` = ? AND `submissions`.`file_name` != ''" +
+		" GROUP BY `submissions`.`class_id`"
+	if err := h.DB.SelectContext(ctx, &submitters, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	submittersMap := lo.Associate(submitters, func(s classSubmitters) (string, int) {
+		return s.ClassID, s.Submitters
+	})
+
+	classes := make([]ClassGradeStats, 0, len(gradebook.Classes))
+	for i, class := range gradebook.Classes {
+		var scores []int
+		for _, row := range gradebook.Rows {
+			if row.Scores[i] != nil {
+				scores = append(scores, *row.Scores[i])
+			}
+		}
+		stats := ClassGradeStats{
+			ClassID:    class.ID,
+			Part:       class.Part,
+			Title:      class.Title,
+			Submitters: submittersMap[class.ID],
+			Scores:     newScoreStats(scores),
+		}
+		if len(gradebook.Rows) > 0 {
+			stats.SubmissionRate = float64(stats.Submitters) / float64(len(gradebook.Rows))
+		}
+		classes = append(classes, stats)
+	}
+
+	// 満点は講義数 x 100点
+	fullScore := 100 * len(gradebook.Classes)
+	width := max(int(math.Ceil(float64(fullScore)/histogramBuckets)), 1)
+	counts := histogramInt(totals, width, histogramBuckets)
+	histogram := make([]HistogramBucket, 0, histogramBuckets)
+	for i, count := range counts {
+		bucket := HistogramBucket{Min: i * width, Max: (i+1)*width - 1, Count: count}
+		if i == histogramBuckets-1 {
+			bucket.Max = max(fullScore, bucket.Max)
+		}
+		histogram = append(histogram, bucket)
+	}
+
+	return c.JSON(http.StatusOK, GetCourseGradesResponse{
+		TotalScores: newScoreStats(totals),
+		Histogram:   histogram,
+		Classes:     classes,
+		Students:    students,
+	})
+}
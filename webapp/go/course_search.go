@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+const searchCoursesLimit = 20
+
+// courseSearchDocument 全文検索の対象。1_schema.sqlのcourses_search_*_indexと同じ式にすること
+const courseSearchDocument = "(`courses`.`name` || ' ' || `courses`.`description` || ' ' || `courses`.`keywords`)"
+
+type courseSortKind int
+
+const (
+	sortKindText courseSortKind = iota
+	sortKindInt
+	sortKindFloat
+)
+
+type courseSortOption struct {
+	expr string
+	kind courseSortKind
+	desc bool // orderを指定しなかった場合の並び順
+}
+
+// courseSortOptions relevanceはkeywordsを指定した場合のみ有効
+var courseSortOptions = map[string]courseSortOption{
+	"code":      {expr: "`courses`.`code`", kind: sortKindText},
+	"name":      {expr: "`courses`.`name`", kind: sortKindText},
+	"credit":    {expr: "`courses`.`credit`", kind: sortKindInt},
+	"period":    {expr: "`courses`.`period`", kind: sortKindInt},
+	"relevance": {expr: "(ts_rank(to_tsvector('simple', " + courseSearchDocument + "), plainto_tsquery('simple', ?)) + similarity(" + courseSearchDocument + ", ?))::float8", kind: sortKindFloat, desc: true},
+}
+
+func (k courseSortKind) cast() string {
+	switch k {
+	case sortKindInt:
+		return "bigint"
+	case sortKindFloat:
+		return "float8"
+	default:
+		return "text"
+	}
+}
+
+func (k courseSortKind) valid(key string) bool {
+	switch k {
+	case sortKindInt:
+		_, err := strconv.ParseInt(key, 10, 64)
+		return err == nil
+	case sortKindFloat:
+		_, err := strconv.ParseFloat(key, 64)
+		return err == nil
+	default:
+		return true
+	}
+}
+
+// courseSearchCursor ページ境界の科目のソートキーとID。Prevがtrueの場合はその科目より前のページを指す
+type courseSearchCursor struct {
+	Sort string `json:"s"`
+	Desc bool   `json:"d"`
+	Key  string `json:"k"`
+	ID   string `json:"i"`
+	Prev bool   `json:"p,omitempty"`
+}
+
+func (cur courseSearchCursor) encode() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCourseSearchCursor(s string) (courseSearchCursor, error) {
+	var cur courseSearchCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, err
+	}
+	err = json.Unmarshal(b, &cur)
+	return cur, err
+}
+
+type searchCourseRow struct {
+	GetCourseDetailResponse
+	SortKey string `db:"sort_key"`
+}
+
+// searchValues カンマ区切りで複数指定された検索条件を返す
+func searchValues(c echo.Context, name string) []string {
+	return lo.FilterMap(strings.Split(c.QueryParam(name), ","), func(v string, _ int) (string, bool) {
+		v = strings.TrimSpace(v)
+		return v, v != ""
+	})
+}
+
+func searchIntValues(c echo.Context, name string) []int {
+	return lo.FilterMap(searchValues(c, name), func(v string, _ int) (int, bool) {
+		n, err := strconv.Atoi(v)
+		return n, err == nil && n > 0
+	})
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func likeContains(s string) string {
+	return "%" + likeEscaper.Replace(s) + "%"
+}
+
+// SearchCourses GET /api/courses 科目検索
+func (h *handlers) SearchCourses(c echo.Context) error {
+	var condition string
+	var args []interface{}
+
+	// 無効な検索条件はエラーを返さず無視して良い
+
+	if courseTypes := searchValues(c, "type"); len(courseTypes) > 0 {
+		condition += " AND `courses`.`type` IN (?)"
+		args = append(args, courseTypes)
+	}
+
+	if credits := searchIntValues(c, "credit"); len(credits) > 0 {
+		condition += " AND `courses`.`credit` IN (?)"
+		args = append(args, credits)
+	}
+
+	if periods := searchIntValues(c, "period"); len(periods) > 0 {
+		condition += " AND `courses`.`period` IN (?)"
+		args = append(args, periods)
+	}
+
+	if days := searchValues(c, "day_of_week"); len(days) > 0 {
+		condition += " AND `courses`.`day_of_week` IN (?)"
+		args = append(args, days)
+	}
+
+	if statuses := searchValues(c, "status"); len(statuses) > 0 {
+		condition += " AND `courses`.`status` IN (?)"
+		args = append(args, statuses)
+	}
+
+	if termIDs := searchValues(c, "term"); len(termIDs) > 0 {
+		condition += " AND `courses`.`term_id` IN (?)"
+		args = append(args, termIDs)
+	}
+
+	// 教員名は部分一致
+	if teachers := searchValues(c, "teacher"); len(teachers) > 0 {
+		teacherConditions := make([]string, 0, len(teachers))
+		for _, teacher := range teachers {
+			teacherConditions = append(teacherConditions, "`users`.`name` ILIKE ?")
+			args = append(args, likeContains(teacher))
+		}
+		condition += " AND (" + strings.Join(teacherConditions, " OR ") + ")"
+	}
+
+	// キーワードは全て含むこと。単語単位の全文検索に加え、日本語のように空白で区切られない文章向けに部分一致(trigramインデックス)でも探す
+	keywords := strings.Fields(c.QueryParam("keywords"))
+	for _, keyword := range keywords {
+		condition += " AND (to_tsvector('simple', " + courseSearchDocument + ") @@ plainto_tsquery('simple', ?) OR " + courseSearchDocument + " ILIKE ?)"
+		args = append(args, keyword, likeContains(keyword))
+	}
+
+	sortName := c.QueryParam("sort")
+	if _, ok := courseSortOptions[sortName]; !ok || (sortName == "relevance" && len(keywords) == 0) {
+		if len(keywords) > 0 {
+			sortName = "relevance"
+		} else {
+			sortName = "code"
+		}
+	}
+	sort := courseSortOptions[sortName]
+	var sortArgs []interface{}
+	if sortName == "relevance" {
+		sortArgs = []interface{}{strings.Join(keywords, " "), strings.Join(keywords, " ")}
+	}
+	desc := sort.desc
+	switch c.QueryParam("order") {
+	case "asc":
+		desc = false
+	case "desc":
+		desc = true
+	}
+
+	var cursor *courseSearchCursor
+	if s := c.QueryParam("cursor"); s != "" {
+		cur, err := decodeCourseSearchCursor(s)
+		if err != nil || cur.Sort != sortName || cur.Desc != desc || !sort.kind.valid(cur.Key) {
+			return c.String(http.StatusBadRequest, "Invalid cursor.")
+		}
+		cursor = &cur
+	}
+
+	// cursor導入前のクライアント向けに、既定ではpageによるページングとする (cursorとは併用できない)。
+	// cursorによるページングはcursorを指定するか、最初のページでpaging=cursorを指定した場合のみ
+	var page int
+	switch c.QueryParam("paging") {
+	case "", "page":
+		if cursor == nil {
+			page = 1
+		}
+	case "cursor":
+	default:
+		return c.String(http.StatusBadRequest, "Invalid paging.")
+	}
+	if s := c.QueryParam("page"); s != "" {
+		var err error
+		page, err = strconv.Atoi(s)
+		if err != nil || page <= 0 {
+			return c.String(http.StatusBadRequest, "Invalid page.")
+		}
+		if cursor != nil {
+			return c.String(http.StatusBadRequest, "The page and cursor parameters cannot be used together.")
+		}
+	}
+
+	// 前のページを取得する場合は逆順に取得して並べ直す
+	backward := cursor != nil && cursor.Prev
+	if cursor != nil {
+		op := ">"
+		if desc != backward {
+			op = "<"
+		}
+		condition += fmt.Sprintf(" AND (%v, `courses`.`id`) %v (CAST(CAST(? AS text) AS %v), ?)", sort.expr, op, sort.kind.cast())
+		args = append(args, sortArgs...)
+		args = append(args, cursor.Key, cursor.ID)
+	}
+
+	direction := "ASC"
+	if desc != backward {
+		direction = "DESC"
+	}
+	condition += fmt.Sprintf(" ORDER BY %v %v, `courses`.`id` %v", sort.expr, direction, direction)
+	args = append(args, sortArgs...)
+
+	// limitより多く上限を設定し、実際にlimitより多くレコードが取得できた場合は次のページが存在する
+	condition += " LIMIT ?"
+	args = append(args, searchCoursesLimit+1)
+	if page > 1 {
+		condition += " OFFSET ?"
+		args = append(args, searchCoursesLimit*(page-1))
+	}
+
+	query := "SELECT `courses`.*, `users`.`name` AS `teacher`, CAST(" + sort.expr + " AS text) AS `sort_key`" +
+		" FROM `courses` JOIN `users` ON `courses`.`teacher_id` = `users`.`id`" +
+		" WHERE `courses`.`archived_at` IS NULL"
+	args = append(append([]interface{}{}, sortArgs...), args...)
+
+	query, args, err := sqlx.In(query+condition, args...)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var rows []searchCourseRow
+	if err := h.DB.SelectContext(c.Request().Context(), &rows, query, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	hasMore := len(rows) > searchCoursesLimit
+	if hasMore {
+		rows = rows[:searchCoursesLimit]
+	}
+	if backward {
+		rows = lo.Reverse(rows)
+	}
+	// カーソルの科目自体が前後のページに存在する
+	hasPrev, hasNext := cursor != nil, hasMore
+	if backward {
+		hasPrev, hasNext = hasMore, true
+	}
+
+	var links []string
+	linkURL, err := url.Parse(c.Request().URL.Path + "?" + c.Request().URL.RawQuery)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	q := linkURL.Query()
+	if page > 0 {
+		if page > 1 {
+			q.Set("page", strconv.Itoa(page-1))
+			linkURL.RawQuery = q.Encode()
+			links = append(links, fmt.Sprintf("<%v>; rel=\"prev\"", linkURL))
+		}
+		if hasMore {
+			q.Set("page", strconv.Itoa(page+1))
+			linkURL.RawQuery = q.Encode()
+			links = append(links, fmt.Sprintf("<%v>; rel=\"next\"", linkURL))
+		}
+	} else {
+		if hasPrev && len(rows) > 0 {
+			first := rows[0]
+			q.Set("cursor", courseSearchCursor{Sort: sortName, Desc: desc, Key: first.SortKey, ID: first.ID, Prev: true}.encode())
+			linkURL.RawQuery = q.Encode()
+			links = append(links, fmt.Sprintf("<%v>; rel=\"prev\"", linkURL))
+		}
+		if hasNext && len(rows) > 0 {
+			last := rows[len(rows)-1]
+			q.Set("cursor", courseSearchCursor{Sort: sortName, Desc: desc, Key: last.SortKey, ID: last.ID}.encode())
+			linkURL.RawQuery = q.Encode()
+			links = append(links, fmt.Sprintf("<%v>; rel=\"next\"", linkURL))
+		}
+	}
+	if len(links) > 0 {
+		c.Response().Header().Set("Link", strings.Join(links, ","))
+	}
+
+	// 結果が0件の時は空配列を返却
+	res := lo.Map(rows, func(row searchCourseRow, _ int) GetCourseDetailResponse {
+		return row.GetCourseDetailResponse
+	})
+	return c.JSON(http.StatusOK, res)
+}
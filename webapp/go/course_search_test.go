@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCourseSearchCursorRoundTrip(t *testing.T) {
+	tests := []courseSearchCursor{
+		{Sort: "name", Key: "Algorithms", ID: "01H0000000000000000000000A"},
+		{Sort: "credit", Desc: true, Key: "2", ID: "01H0000000000000000000000B"},
+		{Sort: "name", Key: "線形代数 ?&=/+", ID: "01H0000000000000000000000C", Prev: true},
+		{Sort: "name", Key: "", ID: ""},
+	}
+	for _, cur := range tests {
+		s := cur.encode()
+		if strings.ContainsAny(s, "+/=&?") {
+			t.Errorf("encode(%+v) = %q, which is not URL safe", cur, s)
+		}
+		got, err := decodeCourseSearchCursor(s)
+		if err != nil {
+			t.Errorf("decodeCourseSearchCursor(%q) returned error: %v", s, err)
+			continue
+		}
+		if got != cur {
+			t.Errorf("decodeCourseSearchCursor(%q) = %+v, want %+v", s, got, cur)
+		}
+	}
+}
+
+func TestDecodeCourseSearchCursorInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+	}{
+		{"not base64", "!!!"},
+		{"padded base64", "e30="},
+		{"not json", "bm90IGpzb24"},
+		{"wrong type", "eyJzIjoxfQ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCourseSearchCursor(tt.s); err == nil {
+				t.Errorf("decodeCourseSearchCursor(%q) returned no error", tt.s)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+// courseStatusTransitions 許可されているステータス遷移 (registration -> in-progress -> closed)
+var courseStatusTransitions = map[CourseStatus][]CourseStatus{
+	StatusRegistration: {StatusInProgress},
+	StatusInProgress:   {StatusClosed},
+	StatusClosed:       {},
+}
+
+func (s CourseStatus) IsValid() bool {
+	_, ok := courseStatusTransitions[s]
+	return ok
+}
+
+func (s CourseStatus) CanTransitionTo(to CourseStatus) bool {
+	return lo.Contains(courseStatusTransitions[s], to)
+}
+
+type courseStatusHook func(ctx context.Context, db sqlx.ExtContext, courseID string, from, to CourseStatus) error
+
+// courseStatusHooks ステータス遷移のcommit後に順に実行される
+var courseStatusHooks = []courseStatusHook{
+	invalidateCourseStatusCache,
+	clearWaitlistOnRegistrationEnd,
+}
+
+func invalidateCourseStatusCache(ctx context.Context, _ sqlx.ExtContext, courseID string, _, _ CourseStatus) error {
+	return rdb.Del(ctx, fmt.Sprintf("%v:%v", CourseStatusCachePrefix, courseID)).Err()
+}
+
+// clearWaitlistOnRegistrationEnd 履修登録期間が終わった科目のキャンセル待ちは繰り上がることがないので消す
+func clearWaitlistOnRegistrationEnd(ctx context.Context, db sqlx.ExtContext, courseID string, from, _ CourseStatus) error {
+	if from != StatusRegistration {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "DELETE FROM `waitlists` WHERE `course_id` = ?", courseID)
+	return err
+}
+
+func runCourseStatusHooks(ctx context.Context, db sqlx.ExtContext, courseID string, from, to CourseStatus) error {
+	for _, hook := range courseStatusHooks {
+		if err := hook(ctx, db, courseID, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type CourseStatusHistory struct {
+	From          CourseStatus `json:"from" db:"from_status"`
+	To            CourseStatus `json:"to" db:"to_status"`
+	ChangedBy     string       `json:"changed_by" db:"changed_by"`
+	ChangedByName string       `json:"changed_by_name" db:"changed_by_name"`
+	ChangedAt     time.Time    `json:"changed_at" db:"changed_at"`
+}
+
+// GetCourseStatusHistory GET /api/courses/:courseID/status/history 科目のステータス変更履歴
+func (h *handlers) GetCourseStatusHistory(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	history := make([]CourseStatusHistory, 0)
+	query := "SELECT `course_status_history`.`from_status`, `course_status_history`.`to_status`, `users`.`code` AS `changed_by`, `users`.`name` AS `changed_by_name`, `course_status_history`.`changed_at`" +
+		" FROM `course_status_history`" +
+		" JOIN `users` ON `users`.`id` = `course_status_history`.`changed_by`" +
+		" WHERE `course_status_history`.`course_id` = ?" +
+		" ORDER BY `course_status_history`.`id`"
+	if err := h.DB.SelectContext(c.Request().Context(), &history, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestCourseStatusCanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from CourseStatus
+		to   CourseStatus
+		want bool
+	}{
+		{StatusRegistration, StatusInProgress, true},
+		{StatusInProgress, StatusClosed, true},
+		{StatusRegistration, StatusClosed, false},
+		{StatusRegistration, StatusRegistration, false},
+		{StatusInProgress, StatusRegistration, false},
+		{StatusClosed, StatusRegistration, false},
+		{StatusClosed, StatusInProgress, false},
+		{StatusClosed, StatusClosed, false},
+		{"unknown", StatusInProgress, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+			t.Errorf("%q.CanTransitionTo(%q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestCourseStatusIsValid(t *testing.T) {
+	tests := []struct {
+		status CourseStatus
+		want   bool
+	}{
+		{StatusRegistration, true},
+		{StatusInProgress, true},
+		{StatusClosed, true},
+		{"", false},
+		{"finished", false},
+	}
+	for _, tt := range tests {
+		if got := tt.status.IsValid(); got != tt.want {
+			t.Errorf("%q.IsValid() = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type CourseTeacher struct {
+	UserCode string `json:"user_code" db:"user_code"`
+	UserName string `json:"user_name" db:"user_name"`
+	IsOwner  bool   `json:"is_owner" db:"is_owner"`
+}
+
+// GetCourseTeachers GET /api/courses/:courseID/teachers 担当教員・共同担当教員一覧
+func (h *handlers) GetCourseTeachers(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	teachers := make([]CourseTeacher, 0)
+	query := "SELECT `users`.`code` AS `user_code`, `users`.`name` AS `user_name`, true AS `is_owner`" +
+		" FROM `courses` JOIN `users` ON `users`.`id` = `courses`.`teacher_id`" +
+		" WHERE `courses`.`id` = ?" +
+		" UNION ALL" +
+		" SELECT `users`.`code` AS `user_code`, `users`.`name` AS `user_name`, false AS `is_owner`" +
+		" FROM `course_teachers` JOIN `users` ON `users`.`id` = `course_teachers`.`user_id`" +
+		" WHERE `course_teachers`.`course_id` = ?" +
+		" ORDER BY `is_owner` DESC, `user_code`"
+	if err := h.DB.SelectContext(c.Request().Context(), &teachers, query, courseID, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, teachers)
+}
+
+type AddCourseTeacherRequest struct {
+	UserCode string `json:"user_code"`
+}
+
+// AddCourseTeacher PUT /api/courses/:courseID/teachers 共同担当教員の追加
+func (h *handlers) AddCourseTeacher(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var req AddCourseTeacherRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+
+	var user User
+	if err := h.DB.GetContext(c.Request().Context(), &user, "SELECT * FROM `users` WHERE `code` = ?", req.UserCode); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such user.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if user.Type != Teacher {
+		return c.String(http.StatusBadRequest, "Co-teachers must be teachers.")
+	}
+
+	var teacherID string
+	if err := h.DB.GetContext(c.Request().Context(), &teacherID, "SELECT `teacher_id` FROM `courses` WHERE `id` = ?", courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such course.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if teacherID == user.ID {
+		return c.String(http.StatusBadRequest, "This user is already the owner of this course.")
+	}
+
+	if _, err := h.DB.ExecContext(c.Request().Context(), "INSERT INTO `course_teachers` (`course_id`, `user_id`) VALUES (?, ?) ON CONFLICT(course_id, user_id) DO NOTHING", courseID, user.ID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RemoveCourseTeacher DELETE /api/courses/:courseID/teachers/:userCode 共同担当教員の削除
+func (h *handlers) RemoveCourseTeacher(c echo.Context) error {
+	courseID := c.Param("courseID")
+	userCode := c.Param("userCode")
+
+	result, err := h.DB.ExecContext(c.Request().Context(), "DELETE FROM `course_teachers` WHERE `course_id` = ? AND `user_id` = (SELECT `id` FROM `users` WHERE `code` = ?)", courseID, userCode)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	ra, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if ra == 0 {
+		return c.String(http.StatusNotFound, "No such co-teacher.")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+// validateCourseFields 科目の登録・更新で共通の入力チェック。エラーの場合はレスポンスのメッセージを返す
+func validateCourseFields(courseType CourseType, dayOfWeek DayOfWeek, credit int, period int, capacity *int) string {
+	if courseType != LiberalArts && courseType != MajorSubjects {
+		return "Invalid course type."
+	}
+	if !contains(daysOfWeek, dayOfWeek) {
+		return "Invalid day of week."
+	}
+	if credit < minCredit || credit > maxCredit {
+		return "Invalid credit."
+	}
+	if period < minPeriod || period > maxPeriod {
+		return "Invalid period."
+	}
+	if capacity != nil && *capacity <= 0 {
+		return "Invalid capacity."
+	}
+	return ""
+}
+
+func courseETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// matchCourseETag If-Matchヘッダが現在の科目のバージョンと一致するか
+func matchCourseETag(ifMatch string, version int) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == courseETag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+type UpdateCourseRequest struct {
+	Type           *CourseType      `json:"type"`
+	Name           *string          `json:"name"`
+	Description    *string          `json:"description"`
+	Credit         *int             `json:"credit"`
+	Period         *int             `json:"period"`
+	DayOfWeek      *DayOfWeek       `json:"day_of_week"`
+	Keywords       *string          `json:"keywords"`
+	Capacity       nullable[int]    `json:"capacity"` // nullの場合は定員なしにする
+	TermID         nullable[string] `json:"term_id"`  // nullの場合は学期未設定にする
+	Archived       *bool            `json:"archived"`
+	GradingScaleID nullable[string] `json:"grading_scale_id"` // nullの場合は既定の尺度にする
+	PassFail       *bool            `json:"pass_fail"`
+}
+
+// UpdateCourse PATCH /api/courses/:courseID 科目の更新
+// 指定したフィールドのみ更新する。If-Matchヘッダに GET /api/courses/:courseID のETagを指定すること
+func (h *handlers) UpdateCourse(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	ifMatch := c.Request().Header.Get("If-Match")
+	if ifMatch == "" {
+		return c.String(http.StatusPreconditionRequired, "If-Match header is required.")
+	}
+
+	var req UpdateCourseRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if req.Name != nil && *req.Name == "" {
+		return c.String(http.StatusBadRequest, "Invalid name.")
+	}
+	if req.TermID.Value != nil {
+		if ok, err := termExists(c.Request().Context(), h.DB, *req.TermID.Value); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		} else if !ok {
+			return c.String(http.StatusBadRequest, "No such term.")
+		}
+	}
+	if req.GradingScaleID.Value != nil {
+		if ok, err := gradingScaleExists(c.Request().Context(), h.DB, *req.GradingScaleID.Value); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		} else if !ok {
+			return c.String(http.StatusBadRequest, "No such grading scale.")
+		}
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var course Course
+	if err := tx.GetContext(ctx, &course, "SELECT * FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such course.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !matchCourseETag(ifMatch, course.Version) {
+		return c.String(http.StatusPreconditionFailed, "The course has been modified.")
+	}
+
+	updated := course
+	if req.Type != nil {
+		updated.Type = *req.Type
+	}
+	if req.Name != nil {
+		updated.Name = *req.Name
+	}
+	if req.Description != nil {
+		updated.Description = *req.Description
+	}
+	if req.Keywords != nil {
+		updated.Keywords = *req.Keywords
+	}
+	if req.DayOfWeek != nil {
+		updated.DayOfWeek = *req.DayOfWeek
+	}
+	if req.TermID.Set {
+		updated.TermID = req.TermID.Value
+	}
+	credit, period := int(course.Credit), int(course.Period)
+	if req.Credit != nil {
+		credit = *req.Credit
+	}
+	if req.Period != nil {
+		period = *req.Period
+	}
+	if req.Capacity.Set {
+		updated.Capacity = req.Capacity.Value
+	}
+	if req.GradingScaleID.Set {
+		updated.GradingScaleID = req.GradingScaleID.Value
+	}
+	if req.PassFail != nil {
+		updated.PassFail = *req.PassFail
+	}
+	if req.Archived != nil && !*req.Archived {
+		updated.ArchivedAt = nil
+	} else if req.Archived != nil && course.ArchivedAt == nil {
+		updated.ArchivedAt = lo.ToPtr(time.Now())
+	}
+
+	if message := validateCourseFields(updated.Type, updated.DayOfWeek, credit, period, updated.Capacity); message != "" {
+		return c.String(http.StatusBadRequest, message)
+	}
+	updated.Credit, updated.Period = uint8(credit), uint8(period)
+
+	// 履修登録期間が終わった後に時間割や単位数を変えると、履修済みの学生の時間割の重複や単位数の上限が崩れる
+	scheduleChanged := updated.Credit != course.Credit || updated.Period != course.Period || updated.DayOfWeek != course.DayOfWeek || termKey(updated.TermID) != termKey(course.TermID)
+	if scheduleChanged && course.Status != StatusRegistration {
+		return c.String(http.StatusConflict, "The schedule of this course cannot be changed after the registration period.")
+	}
+	// 終了した科目の評価方法を変えると、確定した成績やGPAが変わってしまう
+	gradingChanged := lo.FromPtr(updated.GradingScaleID) != lo.FromPtr(course.GradingScaleID) || updated.PassFail != course.PassFail
+	if gradingChanged && course.Status == StatusClosed {
+		return c.String(http.StatusConflict, "The grading of this course cannot be changed after it is closed.")
+	}
+
+	query := "UPDATE `courses` SET `type` = ?, `name` = ?, `description` = ?, `credit` = ?, `period` = ?, `day_of_week` = ?, `keywords` = ?, `capacity` = ?, `term_id` = ?, `archived_at` = ?, `grading_scale_id` = ?, `pass_fail` = ?, `version` = `version` + 1" +
+		" WHERE `id` = ?"
+	if _, err := tx.ExecContext(ctx, query,
+		updated.Type, updated.Name, updated.Description, updated.Credit, updated.Period, updated.DayOfWeek, updated.Keywords, updated.Capacity, updated.TermID, updated.ArchivedAt, updated.GradingScaleID, updated.PassFail, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 定員が増えた場合はキャンセル待ちを繰り上げる
+	var promoted []string
+	if course.Capacity != nil && (updated.Capacity == nil || *updated.Capacity > *course.Capacity) {
+		promoted, err = promoteFromWaitlist(ctx, tx, courseID)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	var res GetCourseDetailResponse
+	query = "SELECT `courses`.*, `users`.`name` AS `teacher`" +
+		" FROM `courses`" +
+		" JOIN `users` ON `courses`.`teacher_id` = `users`.`id`" +
+		" WHERE `courses`.`id` = ?"
+	if err := tx.GetContext(ctx, &res, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	for _, userID := range promoted {
+		if err := rdb.Set(ctx, "course_total_scores:"+courseID+":"+userID, 0, 0).Err(); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	c.Response().Header().Set("ETag", courseETag(res.Version))
+	return c.JSON(http.StatusOK, res)
+}
+
+// ArchiveCourse DELETE /api/courses/:courseID 科目のアーカイブ
+// 科目検索に表示されなくなり新規の履修登録もできなくなるが、履修済みの学生の成績には残る
+func (h *handlers) ArchiveCourse(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	ctx := c.Request().Context()
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var course Course
+	if err := tx.GetContext(ctx, &course, "SELECT * FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such course.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if ifMatch := c.Request().Header.Get("If-Match"); ifMatch != "" && !matchCourseETag(ifMatch, course.Version) {
+		return c.String(http.StatusPreconditionFailed, "The course has been modified.")
+	}
+	if course.ArchivedAt != nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE `courses` SET `archived_at` = ?, `version` = `version` + 1 WHERE `id` = ?", time.Now(), courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
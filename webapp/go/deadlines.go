@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type LatePolicy string
+
+const (
+	// LateReject 締切後の提出を受け付けない
+	LateReject LatePolicy = "reject"
+	// LateAccept 締切後もlate_days日間は提出を受け付け、遅延提出として記録する
+	LateAccept LatePolicy = "accept"
+	// LatePenalty 締切後もlate_days日間は提出を受け付け、1日毎にlate_penalty_per_day点を減点する
+	LatePenalty LatePolicy = "penalty"
+)
+
+// submissionCloseIntervalMS 締切を過ぎた講義の提出を締め切る間隔
+var submissionCloseIntervalMS = GetEnvPositiveInt("SUBMISSION_CLOSE_INTERVAL_MS", 60000)
+
+// validateLatePolicy 講義の登録・更新で共通の締切に関する入力チェック。エラーの場合はレスポンスのメッセージを返す
+func validateLatePolicy(policy LatePolicy, penaltyPerDay int, lateDays int) string {
+	if policy != LateReject && policy != LateAccept && policy != LatePenalty {
+		return "Invalid late policy."
+	}
+	if penaltyPerDay < 0 || penaltyPerDay > 100 {
+		return "Invalid late penalty."
+	}
+	if lateDays < 0 || lateDays > math.MaxInt16 {
+		return "Invalid late days."
+	}
+	return ""
+}
+
+// closesAt 提出を締め切る時刻。締切がない場合はnil
+func (class Class) closesAt() *time.Time {
+	if class.DueAt == nil {
+		return nil
+	}
+	if class.LatePolicy == LateReject {
+		return class.DueAt
+	}
+	t := class.DueAt.AddDate(0, 0, class.LateDays)
+	return &t
+}
+
+// lateness 提出時刻に対する遅延の有無と減点。提出を受け付けない場合はokがfalse
+func (class Class) lateness(submittedAt time.Time) (late bool, penalty int, ok bool) {
+	if class.DueAt == nil || !submittedAt.After(*class.DueAt) {
+		return false, 0, true
+	}
+	if closesAt := class.closesAt(); !submittedAt.Before(*closesAt) {
+		return true, 0, false
+	}
+	if class.LatePolicy == LatePenalty {
+		daysLate := int(math.Ceil(submittedAt.Sub(*class.DueAt).Hours() / 24))
+		penalty = min(daysLate*class.LatePenaltyPerDay, 100)
+	}
+	return true, penalty, true
+}
+
+// closeExpiredClasses 締切(と遅延提出の受付期間)を過ぎた講義の提出を締め切る
+func closeExpiredClasses(ctx context.Context, db sqlx.ExtContext) ([]string, error) {
+	var classIDs []string
+	query := "UPDATE `classes` SET `submission_closed` = true" +
+		" WHERE `submission_closed` = false AND `due_at` IS NOT NULL" +
+		" AND `due_at` + (CASE WHEN `late_policy` = 'reject' THEN 0 ELSE `late_days` END) * INTERVAL '1 day' <= now()" +
+		" RETURNING `id`"
+	if err := sqlx.SelectContext(ctx, db, &classIDs, query); err != nil {
+		return nil, err
+	}
+	return classIDs, nil
+}
+
+// CloseSubmissions PUT /api/courses/:courseID/classes/:classID/assignments/close 課題の提出締め切り
+func (h *handlers) CloseSubmissions(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	result, err := h.DB.ExecContext(c.Request().Context(), "UPDATE `classes` SET `submission_closed` = true, `closed_manually` = true WHERE `id` = ? AND `course_id` = ?", classID, courseID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if n == 0 {
+		return c.String(http.StatusNotFound, "No such class.")
+	}
+
+	if err := enqueueSimilarityAnalysis(c.Request().Context(), classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClassLateness(t *testing.T) {
+	dueAt := time.Date(2026, 4, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		class       Class
+		submittedAt time.Time
+		wantLate    bool
+		wantPenalty int
+		wantOK      bool
+	}{
+		{
+			name:        "no due date",
+			class:       Class{LatePolicy: LateReject},
+			submittedAt: dueAt.AddDate(1, 0, 0),
+			wantOK:      true,
+		},
+		{
+			name:        "before due date",
+			class:       Class{DueAt: &dueAt, LatePolicy: LateReject},
+			submittedAt: dueAt.Add(-time.Minute),
+			wantOK:      true,
+		},
+		{
+			name:        "exactly at due date",
+			class:       Class{DueAt: &dueAt, LatePolicy: LateReject},
+			submittedAt: dueAt,
+			wantOK:      true,
+		},
+		{
+			name:        "rejected after due date",
+			class:       Class{DueAt: &dueAt, LatePolicy: LateReject, LateDays: 3},
+			submittedAt: dueAt.Add(time.Second),
+			wantLate:    true,
+		},
+		{
+			name:        "accepted late",
+			class:       Class{DueAt: &dueAt, LatePolicy: LateAccept, LatePenaltyPerDay: 10, LateDays: 3},
+			submittedAt: dueAt.Add(2 * 24 * time.Hour),
+			wantLate:    true,
+			wantOK:      true,
+		},
+		{
+			name:        "accept period ended",
+			class:       Class{DueAt: &dueAt, LatePolicy: LateAccept, LateDays: 3},
+			submittedAt: dueAt.AddDate(0, 0, 3),
+			wantLate:    true,
+		},
+		{
+			name:        "penalty for a partial day",
+			class:       Class{DueAt: &dueAt, LatePolicy: LatePenalty, LatePenaltyPerDay: 10, LateDays: 3},
+			submittedAt: dueAt.Add(time.Hour),
+			wantLate:    true,
+			wantPenalty: 10,
+			wantOK:      true,
+		},
+		{
+			name:        "penalty for whole days",
+			class:       Class{DueAt: &dueAt, LatePolicy: LatePenalty, LatePenaltyPerDay: 10, LateDays: 3},
+			submittedAt: dueAt.Add(2 * 24 * time.Hour),
+			wantLate:    true,
+			wantPenalty: 20,
+			wantOK:      true,
+		},
+		{
+			name:        "penalty is capped at 100",
+			class:       Class{DueAt: &dueAt, LatePolicy: LatePenalty, LatePenaltyPerDay: 60, LateDays: 3},
+			submittedAt: dueAt.Add(2*24*time.Hour + time.Hour),
+			wantLate:    true,
+			wantPenalty: 100,
+			wantOK:      true,
+		},
+		{
+			name:        "penalty period ended",
+			class:       Class{DueAt: &dueAt, LatePolicy: LatePenalty, LatePenaltyPerDay: 10, LateDays: 3},
+			submittedAt: dueAt.AddDate(0, 0, 3),
+			wantLate:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			late, penalty, ok := tt.class.lateness(tt.submittedAt)
+			if late != tt.wantLate || penalty != tt.wantPenalty || ok != tt.wantOK {
+				t.Errorf("lateness() = (%v, %d, %v), want (%v, %d, %v)", late, penalty, ok, tt.wantLate, tt.wantPenalty, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+type DropCoursesErrorResponse struct {
+	CourseNotFound     []string `json:"course_not_found,omitempty"`
+	NotDroppableStatus []string `json:"not_droppable_status,omitempty"`
+	NotRegistered      []string `json:"not_registered,omitempty"`
+}
+
+// DropCourse DELETE /api/users/me/courses/:courseID 履修取り消し
+func (h *handlers) DropCourse(c echo.Context) error {
+	return h.dropCourses(c, []string{c.Param("courseID")})
+}
+
+// DropCourses DELETE /api/users/me/courses 履修の一括取り消し
+func (h *handlers) DropCourses(c echo.Context) error {
+	var req []RegisterCourseRequestContent
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	courseIDs := lo.Uniq(lo.Map(req, func(r RegisterCourseRequestContent, _ int) string {
+		return r.ID
+	}))
+	return h.dropCourses(c, courseIDs)
+}
+
+// dropCourses 履修登録期間中の科目のみ取り消せる。キャンセル待ち中の科目はキャンセル待ちから外す
+func (h *handlers) dropCourses(c echo.Context, courseIDs []string) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if len(courseIDs) == 0 {
+		return c.NoContent(http.StatusOK)
+	}
+	sort.Strings(courseIDs)
+
+	ctx := c.Request().Context()
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	// キャンセル待ちの繰り上げと競合しないよう、科目の行をid順にロックする
+	query, args, err := sqlx.In("SELECT * FROM `courses` WHERE `id` IN (?) ORDER BY `id` FOR UPDATE", courseIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var courses []Course
+	if err := tx.SelectContext(ctx, &courses, query, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	courseMap := lo.KeyBy(courses, func(course Course) string {
+		return course.ID
+	})
+
+	query, args, err = sqlx.In("SELECT `course_id` FROM `registrations` WHERE `user_id` = ? AND `course_id` IN (?)", userID, courseIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var registeredIDs []string
+	if err := tx.SelectContext(ctx, &registeredIDs, query, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	query, args, err = sqlx.In("SELECT `course_id` FROM `waitlists` WHERE `user_id` = ? AND `course_id` IN (?)", userID, courseIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var waitingIDs []string
+	if err := tx.SelectContext(ctx, &waitingIDs, query, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var errors DropCoursesErrorResponse
+	var dropped, leftWaitlist []string
+	for _, courseID := range courseIDs {
+		course, ok := courseMap[courseID]
+		if !ok {
+			errors.CourseNotFound = append(errors.CourseNotFound, courseID)
+			continue
+		}
+		if lo.Contains(waitingIDs, courseID) {
+			leftWaitlist = append(leftWaitlist, courseID)
+			continue
+		}
+		if !lo.Contains(registeredIDs, courseID) {
+			errors.NotRegistered = append(errors.NotRegistered, courseID)
+			continue
+		}
+		if course.Status != StatusRegistration {
+			errors.NotDroppableStatus = append(errors.NotDroppableStatus, courseID)
+			continue
+		}
+		dropped = append(dropped, courseID)
+	}
+
+	if len(errors.CourseNotFound) > 0 || len(errors.NotRegistered) > 0 || len(errors.NotDroppableStatus) > 0 {
+		return c.JSON(http.StatusBadRequest, errors)
+	}
+
+	if len(leftWaitlist) > 0 {
+		query, args, err = sqlx.In("DELETE FROM `waitlists` WHERE `user_id` = ? AND `course_id` IN (?)", userID, leftWaitlist)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	promoted := make(map[string][]string, len(dropped))
+	if len(dropped) > 0 {
+		query, args, err = sqlx.In("DELETE FROM `registrations` WHERE `user_id` = ? AND `course_id` IN (?)", userID, dropped)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		query, args, err = sqlx.In("DELETE FROM `unread_announcements` WHERE `user_id` = ? AND `announcement_id` IN (SELECT `id` FROM `announcements` WHERE `course_id` IN (?))", userID, dropped)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		for _, courseID := range dropped {
+			userIDs, err := promoteFromWaitlist(ctx, tx, courseID)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			promoted[courseID] = userIDs
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	for _, courseID := range dropped {
+		keys := []string{
+			"course_total_scores:" + courseID + ":" + userID,
+			fmt.Sprintf("%v:%v:%v", getAnnouncementRegistrationsCachePrefix, courseID, userID),
+		}
+		if err := rdb.Del(ctx, keys...).Err(); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		for _, promotedUserID := range promoted[courseID] {
+			if err := rdb.Set(ctx, "course_total_scores:"+courseID+":"+promotedUserID, 0, 0).Err(); err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// 提出ファイルのzipを非同期に作成するジョブ。ジョブの状態はRedisに置き、どのアプリケーションサーバのワーカーでも処理できるようにする
+
+type ExportJobStatus string
+
+const (
+	ExportJobQueued  ExportJobStatus = "queued"
+	ExportJobRunning ExportJobStatus = "running"
+	ExportJobDone    ExportJobStatus = "done"
+	ExportJobFailed  ExportJobStatus = "failed"
+)
+
+const (
+	exportJobQueueKey  = "export_jobs:queue"
+	exportJobExpiryKey = "export_jobs:expiry"
+	// 進捗をRedisに書き込む間隔(ファイル数)
+	exportJobProgressInterval = 10
+)
+
+var (
+	exportJobTTLMin            = GetEnvPositiveInt("EXPORT_JOB_TTL_MIN", 60)
+	exportWorkers              = GetEnvPositiveInt("EXPORT_WORKERS", 2)
+	exportJobCleanupIntervalMS = GetEnvPositiveInt("EXPORT_JOB_CLEANUP_INTERVAL_MS", 60000)
+	exportJobTTL               = time.Duration(exportJobTTLMin) * time.Minute
+)
+
+var errExportJobNotFound = errors.New("export job not found")
+
+func exportJobKey(jobID string) string {
+	return "export_jobs:" + jobID
+}
+
+// updateExportJobScript ジョブのハッシュが存在する場合のみ更新する。
+// 期限切れで消えたジョブをTTLなしで作り直さないようにするため
+var updateExportJobScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], unpack(ARGV))
+return 1
+`)
+
+// updateExportJob ジョブが存在しない場合はerrExportJobNotFoundを返す
+func updateExportJob(ctx context.Context, jobID string, values ...interface{}) error {
+	updated, err := updateExportJobScript.Run(ctx, rdb, []string{exportJobKey(jobID)}, values...).Int()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return errExportJobNotFound
+	}
+	return nil
+}
+
+func exportJobBlobKey(jobID string) string {
+	return "exports/" + jobID + ".zip"
+}
+
+type exportJob struct {
+	CourseID   string          `redis:"course_id"`
+	ClassID    string          `redis:"class_id"`
+	All        bool            `redis:"all"`
+	Status     ExportJobStatus `redis:"status"`
+	Total      int             `redis:"total"`
+	Processed  int             `redis:"processed"`
+	Size       int64           `redis:"size"`
+	Error      string          `redis:"error"`
+	CreatedAt  int64           `redis:"created_at"`
+	FinishedAt int64           `redis:"finished_at"`
+}
+
+func getExportJob(ctx context.Context, jobID string) (exportJob, error) {
+	var job exportJob
+	res := rdb.HGetAll(ctx, exportJobKey(jobID))
+	if err := res.Err(); err != nil {
+		return job, err
+	}
+	if len(res.Val()) == 0 {
+		return job, errExportJobNotFound
+	}
+	if err := res.Scan(&job); err != nil {
+		return job, err
+	}
+	return job, nil
+}
+
+type ExportJobResponse struct {
+	ID          string          `json:"id"`
+	Status      ExportJobStatus `json:"status"`
+	Total       int             `json:"total"`
+	Processed   int             `json:"processed"`
+	Size        int64           `json:"size,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+	DownloadURL string          `json:"download_url,omitempty"`
+}
+
+func (j exportJob) response(jobID string) ExportJobResponse {
+	createdAt := time.Unix(j.CreatedAt, 0)
+	res := ExportJobResponse{
+		ID:        jobID,
+		Status:    j.Status,
+		Total:     j.Total,
+		Processed: j.Processed,
+		Size:      j.Size,
+		Error:     j.Error,
+		CreatedAt: createdAt,
+		ExpiresAt: createdAt.Add(exportJobTTL),
+	}
+	if j.Status == ExportJobDone {
+		res.DownloadURL = fmt.Sprintf("/api/courses/%v/classes/%v/assignments/export-jobs/%v/download", j.CourseID, j.ClassID, jobID)
+	}
+	return res
+}
+
+// AddExportJob POST /api/courses/:courseID/classes/:classID/assignments/export-jobs 提出済みの課題ファイルのzip作成ジョブの登録
+// all=true の場合は全てのバージョンを含める
+func (h *handlers) AddExportJob(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+	all, _ := strconv.ParseBool(c.QueryParam("all"))
+	ctx := c.Request().Context()
+
+	var classCount int
+	if err := h.DB.GetContext(ctx, &classCount, "SELECT 1 FROM `classes` WHERE `id` = ? AND `course_id` = ?", classID, courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such class.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jobID := newULID()
+	job := exportJob{
+		CourseID:  courseID,
+		ClassID:   classID,
+		All:       all,
+		Status:    ExportJobQueued,
+		CreatedAt: time.Now().Unix(),
+	}
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, exportJobKey(jobID),
+			"course_id", job.CourseID,
+			"class_id", job.ClassID,
+			"all", job.All,
+			"status", string(job.Status),
+			"created_at", job.CreatedAt,
+		)
+		pipe.Expire(ctx, exportJobKey(jobID), exportJobTTL)
+		// 作成したzipはジョブと同時に期限切れにする
+		pipe.ZAdd(ctx, exportJobExpiryKey, redis.Z{Score: float64(job.CreatedAt) + exportJobTTL.Seconds(), Member: jobID})
+		pipe.LPush(ctx, exportJobQueueKey, jobID)
+		return nil
+	})
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := job.response(jobID)
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/api/courses/%v/classes/%v/assignments/export-jobs/%v", courseID, classID, jobID))
+	return c.JSON(http.StatusAccepted, res)
+}
+
+// getExportJobOfClass パスの科目・講義のジョブのみ返す
+func getExportJobOfClass(c echo.Context) (string, exportJob, error) {
+	jobID := c.Param("jobID")
+	job, err := getExportJob(c.Request().Context(), jobID)
+	if err != nil {
+		return jobID, job, err
+	}
+	if job.CourseID != c.Param("courseID") || job.ClassID != c.Param("classID") {
+		return jobID, job, errExportJobNotFound
+	}
+	return jobID, job, nil
+}
+
+// GetExportJob GET /api/courses/:courseID/classes/:classID/assignments/export-jobs/:jobID zip作成ジョブの進捗
+func (h *handlers) GetExportJob(c echo.Context) error {
+	jobID, job, err := getExportJobOfClass(c)
+	if errors.Is(err, errExportJobNotFound) {
+		return c.String(http.StatusNotFound, "No such export job.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, job.response(jobID))
+}
+
+// DownloadExportJob GET /api/courses/:courseID/classes/:classID/assignments/export-jobs/:jobID/download 作成したzipのダウンロード
+// Rangeヘッダによる途中からのダウンロードに対応する
+func (h *handlers) DownloadExportJob(c echo.Context) error {
+	jobID, job, err := getExportJobOfClass(c)
+	if errors.Is(err, errExportJobNotFound) {
+		return c.String(http.StatusNotFound, "No such export job.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if job.Status != ExportJobDone {
+		return c.String(http.StatusConflict, "The export job has not finished yet.")
+	}
+
+	f, err := h.Blobs.Open(c.Request().Context(), exportJobBlobKey(jobID))
+	if errors.Is(err, ErrBlobNotFound) {
+		return c.String(http.StatusNotFound, "No such export job.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer f.Close()
+
+	fileName := job.ClassID + ".zip"
+	c.Response().Header().Set(echo.HeaderContentType, "application/zip")
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", fileName))
+	// ETagを付けてIf-Rangeでの再開時に別のファイルと混ざらないようにする
+	c.Response().Header().Set("ETag", `"`+jobID+`"`)
+	http.ServeContent(c.Response(), c.Request(), fileName, time.Unix(job.FinishedAt, 0), f)
+	return nil
+}
+
+// runExportWorker キューからジョブを取り出して処理し続ける
+func (h *handlers) runExportWorker(ctx context.Context, logger echo.Logger) {
+	runQueueWorker(ctx, logger, exportJobQueueKey, func(ctx context.Context, jobID string) error {
+		err := h.processExportJob(ctx, jobID)
+		if errors.Is(err, errExportJobNotFound) {
+			// 期限切れか初期化で消えたジョブ
+			return nil
+		} else if err != nil {
+			if err := updateExportJob(ctx, jobID, "status", string(ExportJobFailed), "error", err.Error()); err != nil && !errors.Is(err, errExportJobNotFound) {
+				logger.Error(err)
+			}
+		}
+		return err
+	})
+}
+
+func (h *handlers) processExportJob(ctx context.Context, jobID string) error {
+	job, err := getExportJob(ctx, jobID)
+	if err != nil {
+		return err
+	}
+
+	submissions, err := getSubmissionsForExport(ctx, h.DB, job.ClassID, job.All)
+	if err != nil {
+		return err
+	}
+	if err := updateExportJob(ctx, jobID, "status", string(ExportJobRunning), "total", len(submissions), "processed", 0); err != nil {
+		return err
+	}
+
+	// BlobStoreに置くにはサイズが必要なので、一度一時ファイルに作成する
+	f, err := os.CreateTemp("", "export-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for i, submission := range submissions {
+		if err := writeZipEntry(ctx, zw, h.Blobs, submission.StorageKey, submission.zipEntryName(job.All)); err != nil {
+			return err
+		}
+		if processed := i + 1; processed%exportJobProgressInterval == 0 || processed == len(submissions) {
+			if err := updateExportJob(ctx, jobID, "processed", processed); err != nil {
+				return err
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := h.Blobs.Put(ctx, exportJobBlobKey(jobID), f, size); err != nil {
+		return err
+	}
+
+	return updateExportJob(ctx, jobID, "status", string(ExportJobDone), "size", size, "finished_at", time.Now().Unix())
+}
+
+// cleanupExportJobs 期限切れのジョブのzipを削除する
+func (h *handlers) cleanupExportJobs(ctx context.Context) error {
+	jobIDs, err := rdb.ZRangeByScore(ctx, exportJobExpiryKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, jobID := range jobIDs {
+		if err := h.Blobs.Delete(ctx, exportJobBlobKey(jobID)); err != nil {
+			return err
+		}
+		if err := rdb.ZRem(ctx, exportJobExpiryKey, jobID).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+// 成績表。行が履修している学生、列が講義(part)の点数の表で、CSV/XLSXでの一括取り込みと書き出しに使う
+
+// gradebookMaxBytes 取り込む成績表ファイルの上限。課題の提出ファイルの上限とは独立して決める
+const gradebookMaxBytes = 5 << 20
+
+// gradebookFormOverhead multipartの境界やファイル以外のフィールドの分
+const gradebookFormOverhead = 64 << 10
+
+type GradebookRow struct {
+	UserID   string
+	UserCode string
+	Name     string
+	Scores   []*int // Gradebook.Classesと同じ順。未採点はnil
+	Total    int
+	TScore   float64
+}
+
+type Gradebook struct {
+	Course  Course
+	Classes []Class
+	Rows    []GradebookRow
+}
+
+// buildGradebook 科目の成績表をDBから作る。合計点とT-scoreは成績照会と同じく履修者全員の合計点から求める
+func buildGradebook(ctx context.Context, db sqlx.QueryerContext, courseID string) (*Gradebook, error) {
+	var gradebook Gradebook
+	if err := sqlx.GetContext(ctx, db, &gradebook.Course, "SELECT * FROM `courses` WHERE `id` = ?", courseID); err != nil {
+		return nil, err
+	}
+	if err := sqlx.SelectContext(ctx, db, &gradebook.Classes, "SELECT * FROM `classes` WHERE `course_id` = ? ORDER BY `part`", courseID); err != nil {
+		return nil, err
+	}
+
+	var users []User
+	query := "SELECT `users`.`id`, `users`.`code`, `users`.`name`" +
+		" FROM `registrations`" +
+		" JOIN `users` ON `users`.`id` = `registrations`.`user_id`" +
+		" WHERE `registrations`.`course_id` = ?" +
+		" ORDER BY `users`.`code`"
+	if err := sqlx.SelectContext(ctx, db, &users, query, courseID); err != nil {
+		return nil, err
+	}
+
+	type submissionScore struct {
+		UserID  string `db:"user_id"`
+		ClassID string `db:"class_id"`
+		Score   int    `db:"score"`
+	}
+	var scores []submissionScore
+	query = "SELECT `submissions`.`user_id`, `submissions`.`class_id`, `submissions`.`score`" +
+		" FROM `submissions`" +
+		" JOIN `classes` ON `classes`.`id` = `submissions`.`class_id`" +
+		" WHERE `classes`.`course_id` = ? AND `submissions`.`score` IS NOT NULL"
+	if err := sqlx.SelectContext(ctx, db, &scores, query, courseID); err != nil {
+		return nil, err
+	}
+	scoreMap := lo.Associate(scores, func(s submissionScore) (string, int) {
+		return s.UserID + ":" + s.ClassID, s.Score
+	})
+
+	totals := make([]int, 0, len(users))
+	gradebook.Rows = make([]GradebookRow, 0, len(users))
+	for _, user := range users {
+		row := GradebookRow{UserID: user.ID, UserCode: user.Code, Name: user.Name, Scores: make([]*int, len(gradebook.Classes))}
+		for i, class := range gradebook.Classes {
+			if score, ok := scoreMap[user.ID+":"+class.ID]; ok {
+				row.Scores[i] = &score
+				row.Total += score
+			}
+		}
+		totals = append(totals, row.Total)
+		gradebook.Rows = append(gradebook.Rows, row)
+	}
+	for i := range gradebook.Rows {
+		gradebook.Rows[i].TScore = tScoreInt(gradebook.Rows[i].Total, totals)
+	}
+
+	return &gradebook, nil
+}
+
+// ExportGradebook GET /api/courses/:courseID/gradebook.csv 成績表のCSVでの書き出し
+// 講義の列の見出しはpartの番号で、そのまま取り込みに使える
+func (h *handlers) ExportGradebook(c echo.Context) error {
+	gradebook, err := buildGradebook(c.Request().Context(), h.DB, c.Param("courseID"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such course.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", gradebook.Course.Code+"-gradebook.csv"))
+	c.Response().WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(c.Response())
+	header := []string{"user_code", "name"}
+	for _, class := range gradebook.Classes {
+		header = append(header, strconv.Itoa(int(class.Part)))
+	}
+	header = append(header, "total", "t_score")
+	if err := w.Write(header); err != nil {
+		c.Logger().Error(err)
+		return nil
+	}
+	for _, row := range gradebook.Rows {
+		record := []string{row.UserCode, row.Name}
+		for _, score := range row.Scores {
+			if score == nil {
+				record = append(record, "")
+			} else {
+				record = append(record, strconv.Itoa(*score))
+			}
+		}
+		record = append(record, strconv.Itoa(row.Total), strconv.FormatFloat(row.TScore, 'f', 2, 64))
+		if err := w.Write(record); err != nil {
+			c.Logger().Error(err)
+			return nil
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		c.Logger().Error(err)
+	}
+	return nil
+}
+
+type GradebookChange struct {
+	UserCode string `json:"user_code"`
+	Part     uint8  `json:"part"`
+	ClassID  string `json:"class_id"`
+	Old      *int   `json:"old"`
+	New      int    `json:"new"`
+}
+
+type ImportGradebookResponse struct {
+	DryRun  bool              `json:"dry_run"`
+	Changes []GradebookChange `json:"changes"`
+}
+
+type ImportGradebookErrorResponse struct {
+	InvalidHeader      []string `json:"invalid_header,omitempty"`
+	UnknownPart        []string `json:"unknown_part,omitempty"`
+	NotClosed          []string `json:"not_closed,omitempty"`
+	NotRegistered      []string `json:"not_registered,omitempty"`
+	DuplicateInRequest []string `json:"duplicate_in_request,omitempty"`
+	InvalidScore       []string `json:"invalid_score,omitempty"` // <user_code>:<part>
+	OutOfRange         []string `json:"out_of_range,omitempty"`  // <user_code>:<part>
+}
+
+func (e ImportGradebookErrorResponse) empty() bool {
+	return len(e.InvalidHeader) == 0 && len(e.UnknownPart) == 0 && len(e.NotClosed) == 0 && len(e.NotRegistered) == 0 &&
+		len(e.DuplicateInRequest) == 0 && len(e.InvalidScore) == 0 && len(e.OutOfRange) == 0
+}
+
+// readGradebookFile アップロードされた成績表をXLSXかCSVとして読む
+func readGradebookFile(fileName string, data []byte) ([][]string, error) {
+	if strings.HasSuffix(strings.ToLower(fileName), ".xlsx") || detectContentType(data) == "application/zip" {
+		return readXLSX(data)
+	}
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	r.FieldsPerRecord = -1
+	return r.ReadAll()
+}
+
+// parseGradebookScore 空欄は変更なし。表計算ソフトが書き出す "85.0" のような値も受け付ける
+func parseGradebookScore(value string) (score int, ok bool, err error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f != math.Trunc(f) {
+		return 0, false, errors.New("invalid score")
+	}
+	return int(f), true, nil
+}
+
+// ImportGradebook POST /api/courses/:courseID/gradebook/import 成績表(CSV/XLSX)の一括取り込み
+// 1行目の見出しは user_code と講義のpartの番号。それ以外の列(name, total, t_score)は無視する。
+// 成績表の点数は遅延提出の減点後の点数として扱う。dry_run=true の場合は変更点のみ返す
+func (h *handlers) ImportGradebook(c echo.Context) error {
+	courseID := c.Param("courseID")
+	dryRun, _ := strconv.ParseBool(c.QueryParam("dry_run"))
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, gradebookMaxBytes+gradebookFormOverhead)
+
+	file, header, err := c.Request().FormFile("file")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("The file must be at most %d bytes.", gradebookMaxBytes))
+	} else if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid file.")
+	}
+	defer file.Close()
+	if header.Size > gradebookMaxBytes {
+		return c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("The file must be at most %d bytes.", gradebookMaxBytes))
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	records, err := readGradebookFile(header.Filename, data)
+	if err != nil || len(records) == 0 {
+		return c.String(http.StatusBadRequest, "Invalid gradebook file.")
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	// 採点(RegisterScores)と同じく講義の行をロックし、合計点の差分が同時の採点と重複しないようにする
+	if _, err := tx.ExecContext(ctx, "SELECT 1 FROM `classes` WHERE `course_id` = ? ORDER BY `id` FOR UPDATE", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	gradebook, err := buildGradebook(ctx, tx, courseID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such course.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var errs ImportGradebookErrorResponse
+
+	// 見出しの列を講義に対応付ける
+	userCodeColumn := -1
+	classColumns := make(map[int]int) // 列 -> gradebook.Classesの添字
+	for col, name := range records[0] {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "user_code":
+			userCodeColumn = col
+		case "name", "total", "t_score", "":
+		default:
+			part, err := strconv.Atoi(name)
+			if err != nil {
+				errs.InvalidHeader = append(errs.InvalidHeader, name)
+				continue
+			}
+			_, i, ok := lo.FindIndexOf(gradebook.Classes, func(class Class) bool {
+				return int(class.Part) == part
+			})
+			if !ok {
+				errs.UnknownPart = append(errs.UnknownPart, name)
+				continue
+			}
+			if _, dup := lo.FindKey(classColumns, i); dup {
+				errs.InvalidHeader = append(errs.InvalidHeader, name)
+				continue
+			}
+			classColumns[col] = i
+		}
+	}
+	if userCodeColumn < 0 {
+		errs.InvalidHeader = append(errs.InvalidHeader, "user_code")
+	}
+	if !errs.empty() {
+		return c.JSON(http.StatusBadRequest, errs)
+	}
+
+	rowMap := lo.KeyBy(gradebook.Rows, func(row GradebookRow) string {
+		return row.UserCode
+	})
+	changes := make([]GradebookChange, 0)
+	changedRows := make(map[string]GradebookRow)
+	notClosed := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, record := range records[1:] {
+		if userCodeColumn >= len(record) || strings.TrimSpace(record[userCodeColumn]) == "" {
+			continue
+		}
+		userCode := strings.TrimSpace(record[userCodeColumn])
+		if seen[userCode] {
+			errs.DuplicateInRequest = append(errs.DuplicateInRequest, userCode)
+			continue
+		}
+		seen[userCode] = true
+		row, ok := rowMap[userCode]
+		if !ok {
+			errs.NotRegistered = append(errs.NotRegistered, userCode)
+			continue
+		}
+
+		for col, i := range classColumns {
+			if col >= len(record) {
+				continue
+			}
+			class := gradebook.Classes[i]
+			cell := fmt.Sprintf("%v:%v", userCode, class.Part)
+			score, ok, err := parseGradebookScore(record[col])
+			if err != nil {
+				errs.InvalidScore = append(errs.InvalidScore, cell)
+				continue
+			} else if !ok {
+				continue
+			}
+			if score < 0 || score > 100 {
+				errs.OutOfRange = append(errs.OutOfRange, cell)
+				continue
+			}
+			if old := row.Scores[i]; old != nil && *old == score {
+				continue
+			}
+			if !class.SubmissionClosed {
+				notClosed[strconv.Itoa(int(class.Part))] = true
+				continue
+			}
+			changes = append(changes, GradebookChange{UserCode: userCode, Part: class.Part, ClassID: class.ID, Old: row.Scores[i], New: score})
+			changedRows[userCode] = row
+		}
+	}
+	errs.DuplicateInRequest = lo.Uniq(errs.DuplicateInRequest)
+	errs.NotClosed = lo.Keys(notClosed)
+	sort.Strings(errs.NotClosed)
+	if !errs.empty() {
+		return c.JSON(http.StatusBadRequest, errs)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].UserCode != changes[j].UserCode {
+			return changes[i].UserCode < changes[j].UserCode
+		}
+		return changes[i].Part < changes[j].Part
+	})
+
+	if dryRun || len(changes) == 0 {
+		return c.JSON(http.StatusOK, ImportGradebookResponse{DryRun: dryRun, Changes: changes})
+	}
+
+	deltas := make(map[string]int)
+	for _, change := range changes {
+		userID := changedRows[change.UserCode].UserID
+		if _, err := tx.ExecContext(ctx, "INSERT INTO `submissions` (`user_id`, `class_id`, `score`, `file_name`) VALUES (?, ?, ?, '')"+
+			" ON CONFLICT(user_id, class_id) DO UPDATE SET `score` = EXCLUDED.score",
+			userID, change.ClassID, change.New); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		// 取り込んだ点数は採点基準ごとの得点と合わなくなるので、基準ごとの得点は消す
+		if _, err := tx.ExecContext(ctx, "DELETE FROM `criterion_scores` WHERE `class_id` = ? AND `user_id` = ?", change.ClassID, userID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		deltas[userID] += change.New - lo.FromPtr(change.Old)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := applyCourseTotalScoreDeltas(ctx, courseID, deltas); err != nil {
+		// DBには反映済みなので、ずれは reconcile-scores で直す
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, ImportGradebookResponse{DryRun: false, Changes: changes})
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseGradebookScore(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantScore int
+		wantOK    bool
+		wantErr   bool
+	}{
+		{"", 0, false, false},
+		{"   ", 0, false, false},
+		{"85", 85, true, false},
+		{" 85 ", 85, true, false},
+		{"85.0", 85, true, false},
+		{"0", 0, true, false},
+		{"-3", -3, true, false},
+		{"85.5", 0, false, true},
+		{"abc", 0, false, true},
+		{"8 5", 0, false, true},
+	}
+	for _, tt := range tests {
+		score, ok, err := parseGradebookScore(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseGradebookScore(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if score != tt.wantScore || ok != tt.wantOK {
+			t.Errorf("parseGradebookScore(%q) = (%d, %v), want (%d, %v)", tt.value, score, ok, tt.wantScore, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+// 合否判定のみの科目の評語
+const (
+	passLetter = "P"
+	failLetter = "F"
+)
+
+// isReservedLetter 合否判定のみの科目の評語と区別できなくなるので、追加する尺度の評語には使えない
+// (既定の尺度のFは不合格の評語として合否判定のFと意味が一致している)
+func isReservedLetter(letter string) bool {
+	return letter == passLetter || letter == failLetter
+}
+
+type GradingScaleGrade struct {
+	ScaleID    string  `json:"-" db:"scale_id"`
+	Letter     string  `json:"letter" db:"letter"`
+	MinScore   int     `json:"min_score" db:"min_score"` // 得点率(%)の下限
+	GradePoint float64 `json:"grade_point" db:"grade_point"`
+	Passing    bool    `json:"passing" db:"passing"`
+}
+
+type GradingScale struct {
+	ID        string              `json:"id" db:"id"`
+	Name      string              `json:"name" db:"name"`
+	IsDefault bool                `json:"is_default" db:"is_default"`
+	Grades    []GradingScaleGrade `json:"grades" db:"-"` // min_scoreの降順
+}
+
+// gradeFor 合計点と講義数から評語を求める。得点率がmin_score%以上の評語のうち最も高いものになる。
+// 講義がない科目の得点率は0%とする (GetGrades のGPA集計のSQLと同じ規則であること)
+func (s *GradingScale) gradeFor(totalScore int, classCount int) GradingScaleGrade {
+	for _, grade := range s.Grades {
+		if grade.MinScore == 0 || (classCount > 0 && totalScore >= grade.MinScore*classCount) {
+			return grade
+		}
+	}
+	// 尺度には必ずmin_scoreが0の評語がある
+	return GradingScaleGrade{ScaleID: s.ID, Letter: failLetter}
+}
+
+type gradingScales struct {
+	byID         map[string]*GradingScale
+	defaultScale *GradingScale
+}
+
+// forCourse 科目の成績評価の尺度。科目で指定されていなければ既定の尺度
+func (s gradingScales) forCourse(course Course) *GradingScale {
+	if scale, ok := s.byID[lo.FromPtr(course.GradingScaleID)]; ok {
+		return scale
+	}
+	return s.defaultScale
+}
+
+// getGradingScales 全ての成績評価の尺度を評語付きで取得する
+func getGradingScales(ctx context.Context, db sqlx.QueryerContext) ([]*GradingScale, error) {
+	var scales []*GradingScale
+	if err := sqlx.SelectContext(ctx, db, &scales, "SELECT * FROM `grading_scales` ORDER BY `is_default` DESC, `id`"); err != nil {
+		return nil, err
+	}
+	var grades []GradingScaleGrade
+	if err := sqlx.SelectContext(ctx, db, &grades, "SELECT * FROM `grading_scale_grades` ORDER BY `scale_id`, `min_score` DESC"); err != nil {
+		return nil, err
+	}
+	scaleGradesMap := lo.GroupBy(grades, func(grade GradingScaleGrade) string {
+		return grade.ScaleID
+	})
+	for _, scale := range scales {
+		scale.Grades = scaleGradesMap[scale.ID]
+	}
+	return scales, nil
+}
+
+func loadGradingScales(ctx context.Context, db sqlx.QueryerContext) (gradingScales, error) {
+	scales, err := getGradingScales(ctx, db)
+	if err != nil {
+		return gradingScales{}, err
+	}
+	res := gradingScales{byID: make(map[string]*GradingScale, len(scales))}
+	for _, scale := range scales {
+		res.byID[scale.ID] = scale
+		if scale.IsDefault {
+			res.defaultScale = scale
+		}
+	}
+	if res.defaultScale == nil {
+		return gradingScales{}, errors.New("default grading scale is not configured")
+	}
+	return res, nil
+}
+
+func gradingScaleExists(ctx context.Context, db sqlx.QueryerContext, scaleID string) (bool, error) {
+	var count int
+	if err := sqlx.GetContext(ctx, db, &count, "SELECT 1 FROM `grading_scales` WHERE `id` = ?", scaleID); errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetGradingScales GET /api/grading-scales 成績評価の尺度一覧
+func (h *handlers) GetGradingScales(c echo.Context) error {
+	scales, err := getGradingScales(c.Request().Context(), h.DB)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, scales)
+}
+
+type AddGradingScaleGradeRequest struct {
+	Letter     string  `json:"letter"`
+	MinScore   int     `json:"min_score"`
+	GradePoint float64 `json:"grade_point"`
+	Passing    bool    `json:"passing"`
+}
+
+type AddGradingScaleRequest struct {
+	Name      string                        `json:"name"`
+	IsDefault bool                          `json:"is_default"`
+	Grades    []AddGradingScaleGradeRequest `json:"grades"`
+}
+
+type AddGradingScaleResponse struct {
+	ID string `json:"id"`
+}
+
+// validateGradingScaleGrades エラーの場合はレスポンスのメッセージを返す
+func validateGradingScaleGrades(grades []AddGradingScaleGradeRequest) string {
+	if len(grades) == 0 {
+		return "Grades are required."
+	}
+	letters := make(map[string]struct{}, len(grades))
+	minScores := make(map[int]struct{}, len(grades))
+	for _, grade := range grades {
+		if grade.Letter == "" || isReservedLetter(grade.Letter) {
+			return "Invalid letter."
+		}
+		if grade.MinScore < 0 || grade.MinScore > 100 {
+			return "Invalid min score."
+		}
+		if grade.GradePoint < 0 {
+			return "Invalid grade point."
+		}
+		if _, ok := letters[grade.Letter]; ok {
+			return "Duplicate letter: " + grade.Letter
+		}
+		if _, ok := minScores[grade.MinScore]; ok {
+			return "Duplicate min score."
+		}
+		letters[grade.Letter] = struct{}{}
+		minScores[grade.MinScore] = struct{}{}
+	}
+	if _, ok := minScores[0]; !ok {
+		return "A grade with min score 0 is required."
+	}
+
+	// 得点率が高い評語ほどGPが低くならないこと
+	sorted := slices.Clone(grades)
+	slices.SortFunc(sorted, func(a, b AddGradingScaleGradeRequest) int {
+		return b.MinScore - a.MinScore
+	})
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].GradePoint > sorted[i-1].GradePoint {
+			return "Grade points must not increase as min score decreases."
+		}
+	}
+	return ""
+}
+
+// AddGradingScale POST /api/grading-scales 成績評価の尺度の追加
+// is_defaultを指定した場合は既定の尺度を置き換える
+func (h *handlers) AddGradingScale(c echo.Context) error {
+	var req AddGradingScaleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if req.Name == "" {
+		return c.String(http.StatusBadRequest, "Invalid name.")
+	}
+	if message := validateGradingScaleGrades(req.Grades); message != "" {
+		return c.String(http.StatusBadRequest, message)
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	if req.IsDefault {
+		if _, err := tx.ExecContext(ctx, "UPDATE `grading_scales` SET `is_default` = false WHERE `is_default`"); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	scaleID := newULID()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO `grading_scales` (`id`, `name`, `is_default`) VALUES (?, ?, ?)", scaleID, req.Name, req.IsDefault); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	grades := lo.Map(req.Grades, func(g AddGradingScaleGradeRequest, _ int) GradingScaleGrade {
+		return GradingScaleGrade{
+			ScaleID:    scaleID,
+			Letter:     g.Letter,
+			MinScore:   g.MinScore,
+			GradePoint: g.GradePoint,
+			Passing:    g.Passing,
+		}
+	})
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO `grading_scale_grades` (`scale_id`, `letter`, `min_score`, `grade_point`, `passing`) VALUES (:scale_id, :letter, :min_score, :grade_point, :passing)", grades); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, AddGradingScaleResponse{ID: scaleID})
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestGradingScaleGradeFor(t *testing.T) {
+	scale := &GradingScale{
+		ID: "scale",
+		Grades: []GradingScaleGrade{
+			{ScaleID: "scale", Letter: "S", MinScore: 90, GradePoint: 4, Passing: true},
+			{ScaleID: "scale", Letter: "A", MinScore: 80, GradePoint: 3, Passing: true},
+			{ScaleID: "scale", Letter: "B", MinScore: 60, GradePoint: 2, Passing: true},
+			{ScaleID: "scale", Letter: "D", MinScore: 0, GradePoint: 0, Passing: false},
+		},
+	}
+	tests := []struct {
+		name       string
+		totalScore int
+		classCount int
+		want       string
+	}{
+		{"full marks", 500, 5, "S"},
+		{"exactly on the boundary", 450, 5, "S"},
+		{"just below the boundary", 449, 5, "A"},
+		{"middle grade", 300, 5, "B"},
+		{"lowest grade", 299, 5, "D"},
+		{"zero score", 0, 5, "D"},
+		{"no classes", 0, 0, "D"},
+		{"score without classes", 100, 0, "D"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scale.gradeFor(tt.totalScore, tt.classCount); got.Letter != tt.want {
+				t.Errorf("gradeFor(%d, %d) = %q, want %q", tt.totalScore, tt.classCount, got.Letter, tt.want)
+			}
+		})
+	}
+}
+
+func TestGradingScaleGradeForWithoutZeroGrade(t *testing.T) {
+	scale := &GradingScale{
+		ID:     "scale",
+		Grades: []GradingScaleGrade{{ScaleID: "scale", Letter: "A", MinScore: 80, GradePoint: 3, Passing: true}},
+	}
+	if got := scale.gradeFor(0, 1); got.Letter != failLetter || got.ScaleID != "scale" {
+		t.Errorf("gradeFor(0, 1) = %+v, want letter %q", got, failLetter)
+	}
+}
+
+func TestValidateGradingScaleGradesReservedLetters(t *testing.T) {
+	tests := []struct {
+		letter string
+		want   string
+	}{
+		{"S", ""},
+		{"", "Invalid letter."},
+		{passLetter, "Invalid letter."},
+		{failLetter, "Invalid letter."},
+	}
+	for _, tt := range tests {
+		grades := []AddGradingScaleGradeRequest{
+			{Letter: tt.letter, MinScore: 60, GradePoint: 1, Passing: true},
+			{Letter: "D", MinScore: 0, GradePoint: 0},
+		}
+		if got := validateGradingScaleGrades(grades); got != tt.want {
+			t.Errorf("validateGradingScaleGrades with letter %q = %q, want %q", tt.letter, got, tt.want)
+		}
+	}
+}
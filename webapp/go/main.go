@@ -2,7 +2,6 @@ package main
 
 import (
 	"archive/zip"
-	"bytes"
 	"context"
 	"database/sql"
 	"errors"
@@ -11,7 +10,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
@@ -37,10 +35,18 @@ const (
 )
 
 type handlers struct {
-	DB *sqlx.DB
+	DB           *sqlx.DB
+	SessionStore *RedisSessionStore
+	Blobs        BlobStore
 }
 
 func main() {
+	rdb = GetRedisClient(context.Background())
+
+	if len(os.Args) > 1 && os.Args[1] == "reconcile-scores" {
+		os.Exit(runReconcileScores(os.Args[2:]))
+	}
+
 	tp, _ := initTracer(context.Background())
 	defer func() {
 		if err := tp.Shutdown(context.Background()); err != nil {
@@ -56,16 +62,44 @@ func main() {
 
 	// e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("trapnomura"))))
+	sessionStore := NewRedisSessionStore(rdb, sessionKeysFromEnv()...)
+	e.Use(session.Middleware(sessionStore))
 	e.Use(otelecho.Middleware("isucholar"))
 
 	db, _ := GetDBOtel()
 	db.SetMaxOpenConns(10)
 
 	h := &handlers{
-		DB: db,
+		DB:           db,
+		SessionStore: sessionStore,
+		Blobs:        newBlobStoreFromEnv(),
 	}
 
+	submissionCloser := NewTicker(submissionCloseIntervalMS, func() {
+		classIDs, err := closeExpiredClasses(context.Background(), db)
+		if err != nil {
+			e.Logger.Error(err)
+			return
+		}
+		if err := enqueueSimilarityAnalysis(context.Background(), classIDs...); err != nil {
+			e.Logger.Error(err)
+		}
+	})
+	go submissionCloser.Start()
+	defer submissionCloser.Stop()
+
+	for i := 0; i < exportWorkers; i++ {
+		go h.runExportWorker(context.Background(), e.Logger)
+	}
+	go h.runSimilarityWorker(context.Background(), e.Logger)
+	exportJobCleaner := NewTicker(exportJobCleanupIntervalMS, func() {
+		if err := h.cleanupExportJobs(context.Background()); err != nil {
+			e.Logger.Error(err)
+		}
+	})
+	go exportJobCleaner.Start()
+	defer exportJobCleaner.Stop()
+
 	e.POST("/initialize", h.Initialize)
 
 	e.POST("/login", h.Login)
@@ -77,24 +111,67 @@ func main() {
 			usersAPI.GET("/me", h.GetMe)
 			usersAPI.GET("/me/courses", h.GetRegisteredCourses)
 			usersAPI.PUT("/me/courses", h.RegisterCourses)
+			usersAPI.DELETE("/me/courses", h.DropCourses)
+			usersAPI.DELETE("/me/courses/:courseID", h.DropCourse)
 			usersAPI.GET("/me/grades", h.GetGrades)
+			usersAPI.GET("/me/timetable", h.GetTimetable)
+			usersAPI.GET("/me/timetable.ics", h.GetTimetableICalendar)
+			usersAPI.DELETE("/:userCode/sessions", h.RevokeUserSessions, h.Authorize(PermRevokeSessions))
 		}
 		coursesAPI := API.Group("/courses")
 		{
 			coursesAPI.GET("", h.SearchCourses)
-			coursesAPI.POST("", h.AddCourse, h.IsAdmin)
+			coursesAPI.POST("", h.AddCourse, h.Authorize(PermAddCourse))
 			coursesAPI.GET("/:courseID", h.GetCourseDetail)
-			coursesAPI.PUT("/:courseID/status", h.SetCourseStatus, h.IsAdmin)
+			coursesAPI.PATCH("/:courseID", h.UpdateCourse, h.Authorize(PermEditCourse))
+			coursesAPI.DELETE("/:courseID", h.ArchiveCourse, h.Authorize(PermEditCourse))
+			coursesAPI.PUT("/:courseID/status", h.SetCourseStatus, h.Authorize(PermSetCourseStatus))
+			coursesAPI.GET("/:courseID/status/history", h.GetCourseStatusHistory, h.Authorize(PermSetCourseStatus))
+			coursesAPI.GET("/:courseID/prerequisites", h.GetCoursePrerequisites)
+			coursesAPI.PUT("/:courseID/prerequisites", h.SetCoursePrerequisites, h.Authorize(PermEditCourse))
 			coursesAPI.GET("/:courseID/classes", h.GetClasses)
-			coursesAPI.POST("/:courseID/classes", h.AddClass, h.IsAdmin)
+			coursesAPI.POST("/:courseID/classes", h.AddClass, h.Authorize(PermAddClass))
+			coursesAPI.PUT("/:courseID/classes/order", h.ReorderClasses, h.Authorize(PermEditClass))
+			coursesAPI.PATCH("/:courseID/classes/:classID", h.UpdateClass, h.Authorize(PermEditClass))
+			coursesAPI.DELETE("/:courseID/classes/:classID", h.DeleteClass, h.Authorize(PermEditClass))
+			coursesAPI.GET("/:courseID/classes/:classID/rubric", h.GetRubric)
+			coursesAPI.PUT("/:courseID/classes/:classID/rubric", h.PutRubric, h.Authorize(PermEditClass))
 			coursesAPI.POST("/:courseID/classes/:classID/assignments", h.SubmitAssignment)
-			coursesAPI.PUT("/:courseID/classes/:classID/assignments/scores", h.RegisterScores, h.IsAdmin)
-			coursesAPI.GET("/:courseID/classes/:classID/assignments/export", h.DownloadSubmittedAssignments, h.IsAdmin)
+			coursesAPI.GET("/:courseID/classes/:classID/assignments/mine", h.GetMySubmissionVersions)
+			coursesAPI.GET("/:courseID/classes/:classID/assignments/versions", h.GetSubmissionVersions, h.Authorize(PermExportAssignments))
+			coursesAPI.GET("/:courseID/classes/:classID/assignments/versions/:versionID", h.DownloadSubmissionVersion)
+			coursesAPI.PUT("/:courseID/classes/:classID/assignments/close", h.CloseSubmissions, h.Authorize(PermCloseAssignments))
+			coursesAPI.PUT("/:courseID/classes/:classID/assignments/scores", h.RegisterScores, h.Authorize(PermRegisterScores))
+			coursesAPI.GET("/:courseID/classes/:classID/assignments/export", h.DownloadSubmittedAssignments, h.Authorize(PermExportAssignments))
+			coursesAPI.GET("/:courseID/classes/:classID/assignments/similarity", h.GetSubmissionSimilarity, h.Authorize(PermExportAssignments))
+			coursesAPI.POST("/:courseID/classes/:classID/assignments/similarity", h.AnalyzeSubmissionSimilarity, h.Authorize(PermExportAssignments))
+			coursesAPI.POST("/:courseID/classes/:classID/assignments/export-jobs", h.AddExportJob, h.Authorize(PermExportAssignments))
+			coursesAPI.GET("/:courseID/classes/:classID/assignments/export-jobs/:jobID", h.GetExportJob, h.Authorize(PermExportAssignments))
+			coursesAPI.GET("/:courseID/classes/:classID/assignments/export-jobs/:jobID/download", h.DownloadExportJob, h.Authorize(PermExportAssignments))
+			coursesAPI.GET("/:courseID/grades", h.GetCourseGrades, h.Authorize(PermViewCourseGrades))
+			coursesAPI.GET("/:courseID/gradebook.csv", h.ExportGradebook, h.Authorize(PermRegisterScores))
+			coursesAPI.POST("/:courseID/gradebook/import", h.ImportGradebook, h.Authorize(PermRegisterScores))
+			coursesAPI.GET("/:courseID/grants", h.GetCourseGrants, h.Authorize(PermManageCourseGrants))
+			coursesAPI.PUT("/:courseID/grants", h.PutCourseGrant, h.Authorize(PermManageCourseGrants))
+			coursesAPI.DELETE("/:courseID/grants/:userCode", h.DeleteCourseGrant, h.Authorize(PermManageCourseGrants))
+			coursesAPI.GET("/:courseID/teachers", h.GetCourseTeachers, h.Authorize(PermManageCourseTeachers))
+			coursesAPI.PUT("/:courseID/teachers", h.AddCourseTeacher, h.Authorize(PermManageCourseTeachers))
+			coursesAPI.DELETE("/:courseID/teachers/:userCode", h.RemoveCourseTeacher, h.Authorize(PermManageCourseTeachers))
+		}
+		termsAPI := API.Group("/terms")
+		{
+			termsAPI.GET("", h.GetTerms)
+			termsAPI.POST("", h.AddTerm, h.Authorize(PermManageTerms))
+		}
+		gradingScalesAPI := API.Group("/grading-scales")
+		{
+			gradingScalesAPI.GET("", h.GetGradingScales)
+			gradingScalesAPI.POST("", h.AddGradingScale, h.Authorize(PermManageGradingScales))
 		}
 		announcementsAPI := API.Group("/announcements")
 		{
 			announcementsAPI.GET("", h.GetAnnouncementList)
-			announcementsAPI.POST("", h.AddAnnouncement, h.IsAdmin)
+			announcementsAPI.POST("", h.AddAnnouncement)
 			announcementsAPI.GET("/:announcementID", h.GetAnnouncementDetail)
 		}
 	}
@@ -118,6 +195,7 @@ func (h *handlers) Initialize(c echo.Context) error {
 		"1_schema.sql",
 		"2_init.sql",
 		"3_sample.sql",
+		"4_backfill.sql",
 	}
 	for _, file := range files {
 		data, err := os.ReadFile(SQLDirectory + file)
@@ -131,11 +209,7 @@ func (h *handlers) Initialize(c echo.Context) error {
 		}
 	}
 
-	if err := exec.Command("rm", "-rf", AssignmentsDirectory).Run(); err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	if err := exec.Command("cp", "-r", InitDataDirectory, AssignmentsDirectory).Run(); err != nil {
+	if err := restoreInitialBlobs(c.Request().Context(), h.Blobs, InitDataDirectory); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
@@ -156,25 +230,13 @@ func (h *handlers) Initialize(c echo.Context) error {
 		}
 	}
 
-	type totalScore struct {
-		UserID     string `db:"user_id"`
-		TotalScore int    `db:"total_score"`
-		CourseID   string `db:"course_id"`
-	}
-	var totalScores []totalScore
-	query := "SELECT users.id AS user_id, courses.id AS course_id, COALESCE(SUM(`submissions`.`score`), 0) AS `total_score`" +
-		" FROM `users`" +
-		" JOIN `registrations` ON `users`.`id` = `registrations`.`user_id`" +
-		" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id`" +
-		" LEFT JOIN `classes` ON `courses`.`id` = `classes`.`course_id`" +
-		" LEFT JOIN `submissions` ON `users`.`id` = `submissions`.`user_id` AND `submissions`.`class_id` = `classes`.`id`" +
-		" GROUP BY `users`.`id`, `courses`.`id`"
-	if err := h.DB.SelectContext(c.Request().Context(), &totalScores, query); err != nil {
+	totalScores, err := computeCourseTotalScores(c.Request().Context(), h.DB)
+	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	for _, ts := range totalScores {
-		if err := rdb.Set(context.Background(), "course_total_scores:"+ts.CourseID+":"+ts.UserID, ts.TotalScore, 0).Err(); err != nil {
+		if err := rdb.Set(context.Background(), courseTotalScoreKey(ts.CourseID, ts.UserID), ts.TotalScore, 0).Err(); err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
@@ -206,27 +268,6 @@ func (h *handlers) IsLoggedIn(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-// IsAdmin admin確認用middleware
-func (h *handlers) IsAdmin(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		sess, err := session.Get(SessionName, c)
-		if err != nil {
-			c.Logger().Error(err)
-			return c.NoContent(http.StatusInternalServerError)
-		}
-		isAdmin, ok := sess.Values["isAdmin"]
-		if !ok {
-			c.Logger().Error("failed to get isAdmin from session")
-			return c.NoContent(http.StatusInternalServerError)
-		}
-		if !isAdmin.(bool) {
-			return c.String(http.StatusForbidden, "You are not admin user.")
-		}
-
-		return next(c)
-	}
-}
-
 func getUserInfo(c echo.Context) (userID string, userName string, isAdmin bool, err error) {
 	sess, err := session.Get(SessionName, c)
 	if err != nil {
@@ -250,8 +291,10 @@ func getUserInfo(c echo.Context) (userID string, userName string, isAdmin bool,
 type UserType string
 
 const (
-	Student UserType = "student"
-	Teacher UserType = "teacher"
+	Student           UserType = "student"
+	TeachingAssistant UserType = "teaching-assistant"
+	Teacher           UserType = "teacher"
+	DepartmentAdmin   UserType = "department-admin"
 )
 
 type User struct {
@@ -281,6 +324,13 @@ const (
 
 var daysOfWeek = []DayOfWeek{Monday, Tuesday, Wednesday, Thursday, Friday}
 
+const (
+	minCredit = 1
+	maxCredit = 10
+	minPeriod = 1
+	maxPeriod = 6
+)
+
 type CourseStatus string
 
 const (
@@ -290,17 +340,23 @@ const (
 )
 
 type Course struct {
-	ID          string       `db:"id"`
-	Code        string       `db:"code"`
-	Type        CourseType   `db:"type"`
-	Name        string       `db:"name"`
-	Description string       `db:"description"`
-	Credit      uint8        `db:"credit"`
-	Period      uint8        `db:"period"`
-	DayOfWeek   DayOfWeek    `db:"day_of_week"`
-	TeacherID   string       `db:"teacher_id"`
-	Keywords    string       `db:"keywords"`
-	Status      CourseStatus `db:"status"`
+	ID             string       `db:"id"`
+	Code           string       `db:"code"`
+	Type           CourseType   `db:"type"`
+	Name           string       `db:"name"`
+	Description    string       `db:"description"`
+	Credit         uint8        `db:"credit"`
+	Period         uint8        `db:"period"`
+	DayOfWeek      DayOfWeek    `db:"day_of_week"`
+	TeacherID      string       `db:"teacher_id"`
+	Keywords       string       `db:"keywords"`
+	Status         CourseStatus `db:"status"`
+	Capacity       *int         `db:"capacity"`
+	TermID         *string      `db:"term_id"`
+	Version        int          `db:"version"`
+	ArchivedAt     *time.Time   `db:"archived_at"`
+	GradingScaleID *string      `db:"grading_scale_id"`
+	PassFail       bool         `db:"pass_fail"`
 }
 
 // ---------- Public API ----------
@@ -339,10 +395,17 @@ func (h *handlers) Login(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "You are already logged in.")
 	}
 
+	// 別のユーザーのセッションを引き継がないよう、ログインの度にセッションIDを発行し直す
+	if err := h.SessionStore.Regenerate(c.Request().Context(), sess); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	sess.Values["userID"] = user.ID
 	sess.Values["userName"] = user.Name
 	sess.Values["code"] = user.Code
-	sess.Values["isAdmin"] = user.Type == Teacher
+	sess.Values["userType"] = string(user.Type)
+	sess.Values["isAdmin"] = user.Type == Teacher || user.Type == DepartmentAdmin
 	sess.Options = &sessions.Options{
 		Path:   "/",
 		MaxAge: 3600,
@@ -380,9 +443,10 @@ func (h *handlers) Logout(c echo.Context) error {
 // ---------- Users API ----------
 
 type GetMeResponse struct {
-	Code    string `json:"code"`
-	Name    string `json:"name"`
-	IsAdmin bool   `json:"is_admin"`
+	Code    string   `json:"code"`
+	Name    string   `json:"name"`
+	IsAdmin bool     `json:"is_admin"`
+	Type    UserType `json:"type"`
 }
 
 // GetMe GET /api/users/me 自身の情報を取得
@@ -400,6 +464,11 @@ func (h *handlers) GetMe(c echo.Context) error {
 	}
 
 	userCode = sess.Values["code"].(string)
+	userType, err := getUserType(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 	// if err := h.DB.GetContext(c.Request().Context(), &userCode, "SELECT `code` FROM `users` WHERE `id` = ?", userID); err != nil {
 	// 	c.Logger().Error(err)
 	// 	return c.NoContent(http.StatusInternalServerError)
@@ -409,15 +478,37 @@ func (h *handlers) GetMe(c echo.Context) error {
 		Code:    userCode,
 		Name:    userName,
 		IsAdmin: isAdmin,
+		Type:    userType,
 	})
 }
 
+// RevokeUserSessions DELETE /api/users/:userCode/sessions 指定したユーザーの全セッションを失効させる
+func (h *handlers) RevokeUserSessions(c echo.Context) error {
+	userCode := c.Param("userCode")
+
+	var userID string
+	if err := h.DB.GetContext(c.Request().Context(), &userID, "SELECT `id` FROM `users` WHERE `code` = ?", userCode); err != nil && err != sql.ErrNoRows {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	} else if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "No such user.")
+	}
+
+	if err := h.SessionStore.RevokeUserSessions(c.Request().Context(), userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
 type GetRegisteredCourseResponseContent struct {
 	ID        string    `json:"id"`
 	Name      string    `json:"name"`
 	Teacher   string    `json:"teacher"`
 	Period    uint8     `json:"period"`
 	DayOfWeek DayOfWeek `json:"day_of_week"`
+	TermID    *string   `json:"term_id"`
 }
 
 // GetRegisteredCourses GET /api/users/me/courses 履修中の科目一覧取得
@@ -441,7 +532,12 @@ func (h *handlers) GetRegisteredCourses(c echo.Context) error {
 		" FROM `courses`" +
 		" JOIN `registrations` ON `courses`.`id` = `registrations`.`course_id`" +
 		" WHERE `courses`.`status` != ? AND `registrations`.`user_id` = ?"
-	if err := db.SelectContext(c.Request().Context(), &courses, query, StatusClosed, userID); err != nil {
+	args := []interface{}{StatusClosed, userID}
+	if termID := c.QueryParam("term"); termID != "" {
+		query += " AND `courses`.`term_id` = ?"
+		args = append(args, termID)
+	}
+	if err := db.SelectContext(c.Request().Context(), &courses, query, args...); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
@@ -478,6 +574,7 @@ func (h *handlers) GetRegisteredCourses(c echo.Context) error {
 			Teacher:   teacher.Name,
 			Period:    course.Period,
 			DayOfWeek: course.DayOfWeek,
+			TermID:    course.TermID,
 		})
 	}
 
@@ -497,6 +594,9 @@ type RegisterCoursesErrorResponse struct {
 	CourseNotFound       []string `json:"course_not_found,omitempty"`
 	NotRegistrableStatus []string `json:"not_registrable_status,omitempty"`
 	ScheduleConflict     []string `json:"schedule_conflict,omitempty"`
+	CapacityExceeded     []string `json:"capacity_exceeded,omitempty"`
+	PrerequisiteMissing  []string `json:"prerequisite_missing,omitempty"`
+	CreditLimitExceeded  []string `json:"credit_limit_exceeded,omitempty"`
 }
 
 // RegisterCourses PUT /api/users/me/courses 履修登録
@@ -536,12 +636,13 @@ func (h *handlers) RegisterCourses(c echo.Context) error {
 		QueryCourseID string       `db:"query_course_id"`
 		ID            string       `db:"id"`
 		Status        CourseStatus `db:"status"`
+		Archived      bool         `db:"archived"`
 	}
 	queryCourse := make([]QueryCourse, 0, len(req))
 
 	// クエリの実行
 	// SELECT query_course_ids.id as query_course_id, courses.* FROM (VALUES ('01FF4RXEKS0DG2EG20CYAYCCGM'), ('01FF4RXEKS0DG2EG20CWPQ60M3'), ('33333333333333333333333333')) as query_course_ids(id) LEFT JOIN isucholar.courses ON query_course_ids.id = isucholar.courses.id
-	bulkQuery := "SELECT query_course_ids.query_course_id as query_course_id, case when courses.id is null then '' else courses.id end as id, case when courses.status is null then '' else courses.status end as status FROM (VALUES " + strings.Join(courseIDSelectsQuerys, ", ") + ") as query_course_ids(query_course_id) LEFT JOIN isucholar.courses ON query_course_ids.query_course_id = isucholar.courses.id"
+	bulkQuery := "SELECT query_course_ids.query_course_id as query_course_id, case when courses.id is null then '' else courses.id end as id, case when courses.status is null then '' else courses.status end as status, coalesce(courses.archived_at is not null, false) as archived FROM (VALUES " + strings.Join(courseIDSelectsQuerys, ", ") + ") as query_course_ids(query_course_id) LEFT JOIN isucholar.courses ON query_course_ids.query_course_id = isucholar.courses.id"
 	err = tx.SelectContext(c.Request().Context(), &queryCourse, bulkQuery)
 	if err != nil {
 		c.Logger().Error(err)
@@ -554,7 +655,7 @@ func (h *handlers) RegisterCourses(c echo.Context) error {
 			continue
 		}
 
-		if qc.Status != StatusRegistration {
+		if qc.Status != StatusRegistration || qc.Archived {
 			errors.NotRegistrableStatus = append(errors.NotRegistrableStatus, qc.ID)
 			continue
 		}
@@ -613,17 +714,51 @@ func (h *handlers) RegisterCourses(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	registrable := lo.Filter(newlyAdded, func(course Course, _ int) bool {
+		return course.Status == StatusRegistration
+	})
+	registrableIDs := lo.Map(registrable, func(course Course, _ int) string {
+		return course.ID
+	})
+	errors.PrerequisiteMissing, err = checkPrerequisites(c.Request().Context(), tx, userID, registrableIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	errors.CreditLimitExceeded = checkCreditLimit(alreadyRegistered, registrable)
+
 	alreadyRegistered = append(alreadyRegistered, newlyAdded...)
 	for _, course1 := range newlyAdded {
 		for _, course2 := range alreadyRegistered {
-			if course1.ID != course2.ID && course1.Period == course2.Period && course1.DayOfWeek == course2.DayOfWeek {
+			if course1.ID != course2.ID && termKey(course1.TermID) == termKey(course2.TermID) && course1.Period == course2.Period && course1.DayOfWeek == course2.DayOfWeek {
 				errors.ScheduleConflict = append(errors.ScheduleConflict, course1.ID)
 				break
 			}
 		}
 	}
 
-	if len(errors.CourseNotFound) > 0 || len(errors.NotRegistrableStatus) > 0 || len(errors.ScheduleConflict) > 0 {
+	errors.CapacityExceeded, err = checkCapacity(c.Request().Context(), tx, registrableIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if len(errors.CourseNotFound) > 0 || len(errors.NotRegistrableStatus) > 0 || len(errors.ScheduleConflict) > 0 ||
+		len(errors.PrerequisiteMissing) > 0 || len(errors.CreditLimitExceeded) > 0 || len(errors.CapacityExceeded) > 0 {
+		// 履修登録は失敗させるが、定員超過のみが理由で失敗した場合は定員超過の科目をキャンセル待ちに並べる。
+		// 履修登録はまだしていないので、同じトランザクションで並べてcommitする
+		capacityOnly := len(errors.CourseNotFound) == 0 && len(errors.NotRegistrableStatus) == 0 && len(errors.ScheduleConflict) == 0 &&
+			len(errors.PrerequisiteMissing) == 0 && len(errors.CreditLimitExceeded) == 0
+		if capacityOnly {
+			if err := enqueueWaitlist(c.Request().Context(), tx, userID, errors.CapacityExceeded); err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			if err := tx.Commit(); err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+		}
 		return c.JSON(http.StatusBadRequest, errors)
 	}
 
@@ -653,12 +788,18 @@ func (h *handlers) RegisterCourses(c echo.Context) error {
 }
 
 type Class struct {
-	ID               string `db:"id"`
-	CourseID         string `db:"course_id"`
-	Part             uint8  `db:"part"`
-	Title            string `db:"title"`
-	Description      string `db:"description"`
-	SubmissionClosed bool   `db:"submission_closed"`
+	ID                string     `db:"id"`
+	CourseID          string     `db:"course_id"`
+	Part              uint8      `db:"part"`
+	Title             string     `db:"title"`
+	Description       string     `db:"description"`
+	SubmissionClosed  bool       `db:"submission_closed"`
+	DueAt             *time.Time `db:"due_at"`
+	LatePolicy        LatePolicy `db:"late_policy"`
+	LatePenaltyPerDay int        `db:"late_penalty_per_day"`
+	LateDays          int        `db:"late_days"`
+	AllowedTypes      string     `db:"allowed_types"` // カンマ区切りのMIMEタイプ
+	ClosedManually    bool       `db:"closed_manually"`
 }
 
 type GetGradeResponse struct {
@@ -667,31 +808,53 @@ type GetGradeResponse struct {
 }
 
 type Summary struct {
-	Credits   int     `json:"credits"`
-	GPA       float64 `json:"gpa"`
-	GpaTScore float64 `json:"gpa_t_score"` // 偏差値
-	GpaAvg    float64 `json:"gpa_avg"`     // 平均値
-	GpaMax    float64 `json:"gpa_max"`     // 最大値
-	GpaMin    float64 `json:"gpa_min"`     // 最小値
+	Credits   int           `json:"credits"`
+	GPA       float64       `json:"gpa"`
+	GpaTScore float64       `json:"gpa_t_score"` // 偏差値
+	GpaAvg    float64       `json:"gpa_avg"`     // 平均値
+	GpaMax    float64       `json:"gpa_max"`     // 最大値
+	GpaMin    float64       `json:"gpa_min"`     // 最小値
+	Terms     []TermSummary `json:"terms"`       // 学期毎の集計
+}
+
+type TermSummary struct {
+	TermID  *string `json:"term_id"`
+	Name    string  `json:"name"`
+	Credits int     `json:"credits"`
+	GPA     float64 `json:"gpa"`
 }
 
 type CourseResult struct {
 	Name             string       `json:"name"`
 	Code             string       `json:"code"`
+	TermID           *string      `json:"term_id"`
 	TotalScore       int          `json:"total_score"`
 	TotalScoreTScore float64      `json:"total_score_t_score"` // 偏差値
 	TotalScoreAvg    float64      `json:"total_score_avg"`     // 平均値
 	TotalScoreMax    int          `json:"total_score_max"`     // 最大値
 	TotalScoreMin    int          `json:"total_score_min"`     // 最小値
+	Grade            *string      `json:"grade"`               // 評語。科目の終了後のみ。合否判定のみの科目は P か F
+	GradePoint       *float64     `json:"grade_point"`         // GP。合否判定のみの科目はnull
+	PassFail         bool         `json:"pass_fail"`
 	ClassScores      []ClassScore `json:"class_scores"`
 }
 
 type ClassScore struct {
-	ClassID    string `json:"class_id"`
-	Title      string `json:"title"`
-	Part       uint8  `json:"part"`
-	Score      *int   `json:"score"`      // 0~100点
-	Submitters int    `json:"submitters"` // 提出した学生数
+	ClassID    string                `json:"class_id"`
+	Title      string                `json:"title"`
+	Part       uint8                 `json:"part"`
+	Score      *int                  `json:"score"`      // 0~100点
+	Submitters int                   `json:"submitters"` // 提出した学生数
+	Feedback   string                `json:"feedback,omitempty"`
+	Criteria   []ClassCriterionScore `json:"criteria,omitempty"` // 採点基準ごとの得点
+}
+
+type ClassCriterionScore struct {
+	ClassID     string `json:"-" db:"class_id"`
+	CriterionID string `json:"criterion_id" db:"criterion_id"`
+	Title       string `json:"title" db:"title"`
+	MaxPoints   int    `json:"max_points" db:"max_points"`
+	Points      int    `json:"points" db:"points"`
 }
 
 // GetGrades GET /api/users/me/grades 成績取得
@@ -717,6 +880,9 @@ func (h *handlers) GetGrades(c echo.Context) error {
 	courseResults := make([]CourseResult, 0, len(registeredCourses))
 	myGPA := 0.0
 	myCredits := 0
+	myGPACredits := 0 // 合否判定のみの科目を除いた単位数
+	termSummaryMap := make(map[string]*TermSummary)
+	termGPACreditsMap := make(map[string]int)
 
 	courseIDs := lo.Map(registeredCourses, func(course Course, _ int) string {
 		return course.ID
@@ -735,13 +901,14 @@ func (h *handlers) GetGrades(c echo.Context) error {
 		return class.CourseID
 	})
 	type submissionScore struct {
-		ClassID string        `db:"class_id"`
-		Score   sql.NullInt16 `db:"score"`
+		ClassID  string        `db:"class_id"`
+		Score    sql.NullInt16 `db:"score"`
+		Feedback string        `db:"feedback"`
 	}
 	classIDs := lo.Map(classes, func(class Class, _ int) string {
 		return class.ID
 	})
-	sqs, args, err := sqlx.In("SELECT class_id, score FROM submissions WHERE class_id IN (?) AND user_id = ?", classIDs, userID)
+	sqs, args, err := sqlx.In("SELECT class_id, score, feedback FROM submissions WHERE class_id IN (?) AND user_id = ?", classIDs, userID)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -751,8 +918,26 @@ func (h *handlers) GetGrades(c echo.Context) error {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	classSubmissionScoreMap := lo.Associate(submissionScores, func(submissionScore submissionScore) (string, sql.NullInt16) {
-		return submissionScore.ClassID, submissionScore.Score
+	classSubmissionScoreMap := lo.Associate(submissionScores, func(submissionScore submissionScore) (string, submissionScore) {
+		return submissionScore.ClassID, submissionScore
+	})
+	query = "SELECT `rubric_criteria`.`class_id`, `rubric_criteria`.`id` AS `criterion_id`, `rubric_criteria`.`title`, `rubric_criteria`.`max_points`, `criterion_scores`.`points`" +
+		" FROM `rubric_criteria`" +
+		" JOIN `criterion_scores` ON `criterion_scores`.`criterion_id` = `rubric_criteria`.`id` AND `criterion_scores`.`user_id` = ?" +
+		" WHERE `rubric_criteria`.`class_id` IN (?)" +
+		" ORDER BY `rubric_criteria`.`position`"
+	ccqs, args, err := sqlx.In(query, userID, classIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var criterionScores []ClassCriterionScore
+	if err := h.DB.SelectContext(c.Request().Context(), &criterionScores, ccqs, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	classCriterionScoresMap := lo.GroupBy(criterionScores, func(cs ClassCriterionScore) string {
+		return cs.ClassID
 	})
 	type courseUser struct {
 		UserID   string `db:"user_id"`
@@ -773,6 +958,11 @@ func (h *handlers) GetGrades(c echo.Context) error {
 	})
 
 	ctx := c.Request().Context()
+	scales, err := loadGradingScales(ctx, h.DB)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 	for _, course := range registeredCourses {
 		classes := courseClassMap[course.ID]
 
@@ -786,8 +976,8 @@ func (h *handlers) GetGrades(c echo.Context) error {
 				c.Logger().Error(err)
 				return c.NoContent(http.StatusInternalServerError)
 			}
-			score, ok := classSubmissionScoreMap[class.ID]
-			if !ok || !score.Valid {
+			submission, ok := classSubmissionScoreMap[class.ID]
+			if !ok || !submission.Score.Valid {
 				classScores = append(classScores, ClassScore{
 					ClassID:    class.ID,
 					Part:       class.Part,
@@ -796,7 +986,7 @@ func (h *handlers) GetGrades(c echo.Context) error {
 					Submitters: submissionsCount,
 				})
 			} else {
-				_score := int(score.Int16)
+				_score := int(submission.Score.Int16)
 				myTotalScore += _score
 				classScores = append(classScores, ClassScore{
 					ClassID:    class.ID,
@@ -804,6 +994,8 @@ func (h *handlers) GetGrades(c echo.Context) error {
 					Title:      class.Title,
 					Score:      &_score,
 					Submitters: submissionsCount,
+					Feedback:   submission.Feedback,
+					Criteria:   classCriterionScoresMap[class.ID],
 				})
 			}
 		}
@@ -823,71 +1015,116 @@ func (h *handlers) GetGrades(c echo.Context) error {
 		//	return c.NoContent(http.StatusInternalServerError)
 		//}
 		registeredUsers := courseUserIDsMap[course.ID]
-		totalKeys := lo.Map(registeredUsers, func(cu courseUser, _ int) string {
-			return fmt.Sprintf("course_total_scores:%s:%s", course.ID, cu.UserID)
-		})
-		_totals, err := rdb.MGet(ctx, totalKeys...).Result()
+		totals, err := getCourseTotalScores(ctx, course.ID, lo.Map(registeredUsers, func(cu courseUser, _ int) string {
+			return cu.UserID
+		}))
 		if err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
-		totals := make([]int, 0, len(registeredUsers))
-		for _, _total := range _totals {
-			if _total == nil {
-				totals = append(totals, 0)
-				continue
-			}
-			total, err := strconv.Atoi(_total.(string))
-			if err != nil {
-				c.Logger().Error(err)
-				return c.NoContent(http.StatusInternalServerError)
-			}
-			totals = append(totals, total)
-		}
 
-		courseResults = append(courseResults, CourseResult{
+		courseResult := CourseResult{
 			Name:             course.Name,
 			Code:             course.Code,
+			TermID:           course.TermID,
 			TotalScore:       myTotalScore,
 			TotalScoreTScore: tScoreInt(myTotalScore, totals),
 			TotalScoreAvg:    averageInt(totals, 0),
 			TotalScoreMax:    maxInt(totals, 0),
 			TotalScoreMin:    minInt(totals, 0),
+			PassFail:         course.PassFail,
 			ClassScores:      classScores,
-		})
+		}
 
-		// 自分のGPA計算
+		// 評語と自分のGPA計算
 		if course.Status == StatusClosed {
-			myGPA += float64(myTotalScore * int(course.Credit))
+			grade := scales.forCourse(course).gradeFor(myTotalScore, len(classes))
+			if course.PassFail {
+				courseResult.Grade = lo.ToPtr(lo.Ternary(grade.Passing, passLetter, failLetter))
+			} else {
+				courseResult.Grade = lo.ToPtr(grade.Letter)
+				courseResult.GradePoint = lo.ToPtr(grade.GradePoint)
+			}
+
+			termSummary, ok := termSummaryMap[termKey(course.TermID)]
+			if !ok {
+				termSummary = &TermSummary{TermID: course.TermID}
+				termSummaryMap[termKey(course.TermID)] = termSummary
+			}
 			myCredits += int(course.Credit)
+			termSummary.Credits += int(course.Credit)
+			if !course.PassFail {
+				myGPA += grade.GradePoint * float64(course.Credit)
+				myGPACredits += int(course.Credit)
+				termSummary.GPA += grade.GradePoint * float64(course.Credit)
+				termGPACreditsMap[termKey(course.TermID)] += int(course.Credit)
+			}
 		}
+		courseResults = append(courseResults, courseResult)
 	}
-	if myCredits > 0 {
-		myGPA = myGPA / 100 / float64(myCredits)
+	if myGPACredits > 0 {
+		myGPA = myGPA / float64(myGPACredits)
+	}
+
+	// 学期毎のGPA (学期の開始日順、学期未設定は最後)
+	termSummaries := make([]TermSummary, 0, len(termSummaryMap))
+	if len(termSummaryMap) > 0 {
+		var terms []Term
+		tqs, args, err := sqlx.In(selectTermsQuery+" WHERE `id` IN (?) ORDER BY `starts_on`, `id`", append(lo.Keys(termSummaryMap), ""))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if err := h.DB.SelectContext(c.Request().Context(), &terms, tqs, args...); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		for _, term := range terms {
+			if termSummary, ok := termSummaryMap[term.ID]; ok {
+				termSummary.Name = term.Name
+				termSummaries = append(termSummaries, *termSummary)
+			}
+		}
+		if termSummary, ok := termSummaryMap[""]; ok {
+			termSummaries = append(termSummaries, *termSummary)
+		}
+		for i := range termSummaries {
+			if gpaCredits := termGPACreditsMap[termKey(termSummaries[i].TermID)]; gpaCredits > 0 {
+				termSummaries[i].GPA = termSummaries[i].GPA / float64(gpaCredits)
+			}
+		}
 	}
 	now := time.Now()
 	gpas := onmemoryGPAs
 	if latestGPAs.IsZero() || len(gpas) == 0 || latestGPAs.Add(time.Second*3).Unix() < now.Unix() {
 		gpasIf, err, _ := gpasSingleflight.Do("gpas", func() (interface{}, error) {
 			// GPAの統計値
-			// 一つでも修了した科目がある学生のGPA一覧
+			// 合否判定のみでない科目を一つでも修了した学生のGPA一覧
+			// 評語の決め方は GradingScale.gradeFor と同じ (講義がない科目の得点率は0%)
 			var gpas []float64
-			query = "SELECT COALESCE(SUM(submissions.score::float * courses.credit::float), 0) / 100 / credits.credits::float AS `gpa`" +
-				" FROM `users`" +
-				" JOIN (" +
-				"     SELECT `users`.`id` AS `user_id`, SUM(`courses`.`credit`) AS `credits`" +
+			query = "SELECT SUM(`grades`.`grade_point` * `course_totals`.`credit`) / SUM(`course_totals`.`credit`) AS `gpa`" +
+				" FROM (" +
+				"     SELECT `users`.`id` AS `user_id`, `courses`.`credit`," +
+				"         COALESCE(`courses`.`grading_scale_id`, (SELECT `id` FROM `grading_scales` WHERE `is_default`)) AS `scale_id`," +
+				"         COALESCE(SUM(`submissions`.`score`), 0) AS `total_score`, COUNT(`classes`.`id`) AS `classes`" +
 				"     FROM `users`" +
 				"     JOIN `registrations` ON `users`.`id` = `registrations`.`user_id`" +
-				"     JOIN `courses` ON `registrations`.`course_id` = `courses`.`id` AND `courses`.`status` = ?" +
-				"     GROUP BY `users`.`id`" +
-				" ) AS `credits` ON `credits`.`user_id` = `users`.`id`" +
-				" JOIN `registrations` ON `users`.`id` = `registrations`.`user_id`" +
-				" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id` AND `courses`.`status` = ?" +
-				" LEFT JOIN `classes` ON `courses`.`id` = `classes`.`course_id`" +
-				" LEFT JOIN `submissions` ON `users`.`id` = `submissions`.`user_id` AND `submissions`.`class_id` = `classes`.`id`" +
-				" WHERE `users`.`type` = ?" +
-				" GROUP BY `users`.`id`, credits.credits"
-			if err := h.DB.SelectContext(c.Request().Context(), &gpas, query, StatusClosed, StatusClosed, Student); err != nil {
+				"     JOIN `courses` ON `registrations`.`course_id` = `courses`.`id` AND `courses`.`status` = ? AND NOT `courses`.`pass_fail`" +
+				"     LEFT JOIN `classes` ON `courses`.`id` = `classes`.`course_id`" +
+				"     LEFT JOIN `submissions` ON `users`.`id` = `submissions`.`user_id` AND `submissions`.`class_id` = `classes`.`id`" +
+				"     WHERE `users`.`type` = ?" +
+				"     GROUP BY `users`.`id`, `courses`.`id`" +
+				" ) AS `course_totals`" +
+				" JOIN LATERAL (" +
+				"     SELECT `grading_scale_grades`.`grade_point`" +
+				"     FROM `grading_scale_grades`" +
+				"     WHERE `grading_scale_grades`.`scale_id` = `course_totals`.`scale_id`" +
+				"         AND (`grading_scale_grades`.`min_score` = 0 OR (`course_totals`.`classes` > 0 AND `course_totals`.`total_score` >= `grading_scale_grades`.`min_score` * `course_totals`.`classes`))" +
+				"     ORDER BY `grading_scale_grades`.`min_score` DESC" +
+				"     LIMIT 1" +
+				" ) AS `grades` ON true" +
+				" GROUP BY `course_totals`.`user_id`"
+			if err := h.DB.SelectContext(c.Request().Context(), &gpas, query, StatusClosed, Student); err != nil {
 				c.Logger().Error(err)
 				return nil, c.NoContent(http.StatusInternalServerError)
 			}
@@ -910,6 +1147,7 @@ func (h *handlers) GetGrades(c echo.Context) error {
 			GpaAvg:    averageFloat64(gpas, 0),
 			GpaMax:    maxFloat64(gpas, 0),
 			GpaMin:    minFloat64(gpas, 0),
+			Terms:     termSummaries,
 		},
 		CourseResults: courseResults,
 	}
@@ -925,125 +1163,19 @@ var (
 
 // ---------- Courses API ----------
 
-// SearchCourses GET /api/courses 科目検索
-func (h *handlers) SearchCourses(c echo.Context) error {
-	query := "SELECT `courses`.*, `users`.`name` AS `teacher`" +
-		" FROM `courses` JOIN `users` ON `courses`.`teacher_id` = `users`.`id`" +
-		" WHERE 1=1"
-	var condition string
-	var args []interface{}
-
-	// 無効な検索条件はエラーを返さず無視して良い
-
-	if courseType := c.QueryParam("type"); courseType != "" {
-		condition += " AND `courses`.`type` = ?"
-		args = append(args, courseType)
-	}
-
-	if credit, err := strconv.Atoi(c.QueryParam("credit")); err == nil && credit > 0 {
-		condition += " AND `courses`.`credit` = ?"
-		args = append(args, credit)
-	}
-
-	if teacher := c.QueryParam("teacher"); teacher != "" {
-		condition += " AND `users`.`name` = ?"
-		args = append(args, teacher)
-	}
-
-	if period, err := strconv.Atoi(c.QueryParam("period")); err == nil && period > 0 {
-		condition += " AND `courses`.`period` = ?"
-		args = append(args, period)
-	}
-
-	if dayOfWeek := c.QueryParam("day_of_week"); dayOfWeek != "" {
-		condition += " AND `courses`.`day_of_week` = ?"
-		args = append(args, dayOfWeek)
-	}
-
-	if keywords := c.QueryParam("keywords"); keywords != "" {
-		arr := strings.Split(keywords, " ")
-		var nameCondition string
-		for _, keyword := range arr {
-			nameCondition += " AND `courses`.`name` LIKE ?"
-			args = append(args, "%"+keyword+"%")
-		}
-		var keywordsCondition string
-		for _, keyword := range arr {
-			keywordsCondition += " AND `courses`.`keywords` LIKE ?"
-			args = append(args, "%"+keyword+"%")
-		}
-		condition += fmt.Sprintf(" AND ((1=1%s) OR (1=1%s))", nameCondition, keywordsCondition)
-	}
-
-	if status := c.QueryParam("status"); status != "" {
-		condition += " AND `courses`.`status` = ?"
-		args = append(args, status)
-	}
-
-	condition += " ORDER BY `courses`.`code`"
-
-	var page int
-	if c.QueryParam("page") == "" {
-		page = 1
-	} else {
-		var err error
-		page, err = strconv.Atoi(c.QueryParam("page"))
-		if err != nil || page <= 0 {
-			return c.String(http.StatusBadRequest, "Invalid page.")
-		}
-	}
-	limit := 20
-	offset := limit * (page - 1)
-
-	// limitより多く上限を設定し、実際にlimitより多くレコードが取得できた場合は次のページが存在する
-	condition += " LIMIT ? OFFSET ?"
-	args = append(args, limit+1, offset)
-
-	// 結果が0件の時は空配列を返却
-	res := make([]GetCourseDetailResponse, 0)
-	if err := h.DB.SelectContext(c.Request().Context(), &res, query+condition, args...); err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	var links []string
-	linkURL, err := url.Parse(c.Request().URL.Path + "?" + c.Request().URL.RawQuery)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	q := linkURL.Query()
-	if page > 1 {
-		q.Set("page", strconv.Itoa(page-1))
-		linkURL.RawQuery = q.Encode()
-		links = append(links, fmt.Sprintf("<%v>; rel=\"prev\"", linkURL))
-	}
-	if len(res) > limit {
-		q.Set("page", strconv.Itoa(page+1))
-		linkURL.RawQuery = q.Encode()
-		links = append(links, fmt.Sprintf("<%v>; rel=\"next\"", linkURL))
-	}
-	if len(links) > 0 {
-		c.Response().Header().Set("Link", strings.Join(links, ","))
-	}
-
-	if len(res) == limit+1 {
-		res = res[:len(res)-1]
-	}
-
-	return c.JSON(http.StatusOK, res)
-}
-
 type AddCourseRequest struct {
-	Code        string     `json:"code"`
-	Type        CourseType `json:"type"`
-	Name        string     `json:"name"`
-	Description string     `json:"description"`
-	Credit      int        `json:"credit"`
-	Period      int        `json:"period"`
-	DayOfWeek   DayOfWeek  `json:"day_of_week"`
-	Keywords    string     `json:"keywords"`
+	Code           string     `json:"code"`
+	Type           CourseType `json:"type"`
+	Name           string     `json:"name"`
+	Description    string     `json:"description"`
+	Credit         int        `json:"credit"`
+	Period         int        `json:"period"`
+	DayOfWeek      DayOfWeek  `json:"day_of_week"`
+	Keywords       string     `json:"keywords"`
+	Capacity       *int       `json:"capacity"`
+	TermID         *string    `json:"term_id"`
+	GradingScaleID *string    `json:"grading_scale_id"`
+	PassFail       bool       `json:"pass_fail"`
 }
 
 type AddCourseResponse struct {
@@ -1063,16 +1195,29 @@ func (h *handlers) AddCourse(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid format.")
 	}
 
-	if req.Type != LiberalArts && req.Type != MajorSubjects {
-		return c.String(http.StatusBadRequest, "Invalid course type.")
+	if message := validateCourseFields(req.Type, req.DayOfWeek, req.Credit, req.Period, req.Capacity); message != "" {
+		return c.String(http.StatusBadRequest, message)
 	}
-	if !contains(daysOfWeek, req.DayOfWeek) {
-		return c.String(http.StatusBadRequest, "Invalid day of week.")
+	if req.TermID != nil {
+		if ok, err := termExists(c.Request().Context(), h.DB, *req.TermID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		} else if !ok {
+			return c.String(http.StatusBadRequest, "No such term.")
+		}
+	}
+	if req.GradingScaleID != nil {
+		if ok, err := gradingScaleExists(c.Request().Context(), h.DB, *req.GradingScaleID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		} else if !ok {
+			return c.String(http.StatusBadRequest, "No such grading scale.")
+		}
 	}
 
 	courseID := newULID()
-	_, err = h.DB.ExecContext(c.Request().Context(), "INSERT INTO `courses` (`id`, `code`, `type`, `name`, `description`, `credit`, `period`, `day_of_week`, `teacher_id`, `keywords`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		courseID, req.Code, req.Type, req.Name, req.Description, req.Credit, req.Period, req.DayOfWeek, userID, req.Keywords)
+	_, err = h.DB.ExecContext(c.Request().Context(), "INSERT INTO `courses` (`id`, `code`, `type`, `name`, `description`, `credit`, `period`, `day_of_week`, `teacher_id`, `keywords`, `capacity`, `term_id`, `grading_scale_id`, `pass_fail`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		courseID, req.Code, req.Type, req.Name, req.Description, req.Credit, req.Period, req.DayOfWeek, userID, req.Keywords, req.Capacity, req.TermID, req.GradingScaleID, req.PassFail)
 	if err != nil {
 		if pgxIsDuplicateError(err) {
 			var course Course
@@ -1080,7 +1225,7 @@ func (h *handlers) AddCourse(c echo.Context) error {
 				c.Logger().Error(err)
 				return c.NoContent(http.StatusInternalServerError)
 			}
-			if req.Type != course.Type || req.Name != course.Name || req.Description != course.Description || req.Credit != int(course.Credit) || req.Period != int(course.Period) || req.DayOfWeek != course.DayOfWeek || req.Keywords != course.Keywords {
+			if req.Type != course.Type || req.Name != course.Name || req.Description != course.Description || req.Credit != int(course.Credit) || req.Period != int(course.Period) || req.DayOfWeek != course.DayOfWeek || req.Keywords != course.Keywords || lo.FromPtr(req.Capacity) != lo.FromPtr(course.Capacity) || termKey(req.TermID) != termKey(course.TermID) || lo.FromPtr(req.GradingScaleID) != lo.FromPtr(course.GradingScaleID) || req.PassFail != course.PassFail {
 				return c.String(http.StatusConflict, "A course with the same code already exists.")
 			}
 			return c.JSON(http.StatusCreated, AddCourseResponse{ID: course.ID})
@@ -1093,18 +1238,24 @@ func (h *handlers) AddCourse(c echo.Context) error {
 }
 
 type GetCourseDetailResponse struct {
-	ID          string       `json:"id" db:"id"`
-	Code        string       `json:"code" db:"code"`
-	Type        string       `json:"type" db:"type"`
-	Name        string       `json:"name" db:"name"`
-	Description string       `json:"description" db:"description"`
-	Credit      uint8        `json:"credit" db:"credit"`
-	Period      uint8        `json:"period" db:"period"`
-	DayOfWeek   string       `json:"day_of_week" db:"day_of_week"`
-	TeacherID   string       `json:"-" db:"teacher_id"`
-	Keywords    string       `json:"keywords" db:"keywords"`
-	Status      CourseStatus `json:"status" db:"status"`
-	Teacher     string       `json:"teacher" db:"teacher"`
+	ID             string       `json:"id" db:"id"`
+	Code           string       `json:"code" db:"code"`
+	Type           string       `json:"type" db:"type"`
+	Name           string       `json:"name" db:"name"`
+	Description    string       `json:"description" db:"description"`
+	Credit         uint8        `json:"credit" db:"credit"`
+	Period         uint8        `json:"period" db:"period"`
+	DayOfWeek      string       `json:"day_of_week" db:"day_of_week"`
+	TeacherID      string       `json:"-" db:"teacher_id"`
+	Keywords       string       `json:"keywords" db:"keywords"`
+	Status         CourseStatus `json:"status" db:"status"`
+	Capacity       *int         `json:"capacity" db:"capacity"`
+	TermID         *string      `json:"term_id" db:"term_id"`
+	Version        int          `json:"-" db:"version"`
+	ArchivedAt     *time.Time   `json:"archived_at,omitempty" db:"archived_at"`
+	GradingScaleID *string      `json:"grading_scale_id" db:"grading_scale_id"` // nullは既定の尺度
+	PassFail       bool         `json:"pass_fail" db:"pass_fail"`
+	Teacher        string       `json:"teacher" db:"teacher"`
 }
 
 // GetCourseDetail GET /api/courses/:courseID 科目詳細の取得
@@ -1123,6 +1274,7 @@ func (h *handlers) GetCourseDetail(c echo.Context) error {
 		return c.String(http.StatusNotFound, "No such course.")
 	}
 
+	c.Response().Header().Set("ETag", courseETag(res.Version))
 	return c.JSON(http.StatusOK, res)
 }
 
@@ -1132,60 +1284,87 @@ type SetCourseStatusRequest struct {
 
 // SetCourseStatus PUT /api/courses/:courseID/status 科目のステータスを変更
 func (h *handlers) SetCourseStatus(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	courseID := c.Param("courseID")
 
 	var req SetCourseStatusRequest
 	if err := c.Bind(&req); err != nil {
 		return c.String(http.StatusBadRequest, "Invalid format.")
 	}
+	if !req.Status.IsValid() {
+		return c.String(http.StatusBadRequest, "Invalid course status.")
+	}
 
-	//var count int
-	//if err := tx.GetContext(c.Request().Context(), &count, "SELECT 1 FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); errors.Is(err, sql.ErrNoRows) {
-	//	return c.String(http.StatusNotFound, "No such course.")
-	//} else if err != nil {
-	//	c.Logger().Error(err)
-	//	return c.NoContent(http.StatusInternalServerError)
-	//}
+	tx, err := h.DB.BeginTxx(c.Request().Context(), nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var current CourseStatus
+	if err := tx.GetContext(c.Request().Context(), &current, "SELECT `status` FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such course.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 同じステータスへの変更は何もしない
+	if current == req.Status {
+		return c.NoContent(http.StatusOK)
+	}
+	if !current.CanTransitionTo(req.Status) {
+		return c.String(http.StatusConflict, fmt.Sprintf("Cannot change course status from %v to %v.", current, req.Status))
+	}
 
-	var result sql.Result
-	var err error
-	if result, err = h.DB.ExecContext(c.Request().Context(), "UPDATE `courses` SET `status` = ? WHERE `id` = ?", req.Status, courseID); err != nil {
+	if _, err := tx.ExecContext(c.Request().Context(), "UPDATE `courses` SET `status` = ?, `version` = `version` + 1 WHERE `id` = ?", req.Status, courseID); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	if err := rdb.Del(c.Request().Context(), fmt.Sprintf("%v:%v", CourseStatusCachePrefix, courseID)).Err(); err != nil {
+	if _, err := tx.ExecContext(c.Request().Context(), "INSERT INTO `course_status_history` (`id`, `course_id`, `from_status`, `to_status`, `changed_by`) VALUES (?, ?, ?, ?, ?)",
+		newULID(), courseID, current, req.Status, userID); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	ra, err := result.RowsAffected()
-	if err != nil {
+
+	if err := tx.Commit(); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	if ra == 0 {
-		return c.String(http.StatusNotFound, "No such course.")
+
+	if err := runCourseStatusHooks(c.Request().Context(), h.DB, courseID, current, req.Status); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	return c.NoContent(http.StatusOK)
 }
 
 type ClassWithSubmitted struct {
-	ID               string `db:"id"`
-	CourseID         string `db:"course_id"`
-	Part             uint8  `db:"part"`
-	Title            string `db:"title"`
-	Description      string `db:"description"`
-	SubmissionClosed bool   `db:"submission_closed"`
-	Submitted        bool   `db:"submitted"`
+	Class
+	Submitted bool `db:"submitted"`
+	Late      bool `db:"late"`
 }
 
 type GetClassResponse struct {
-	ID               string `json:"id"`
-	Part             uint8  `json:"part"`
-	Title            string `json:"title"`
-	Description      string `json:"description"`
-	SubmissionClosed bool   `json:"submission_closed"`
-	Submitted        bool   `json:"submitted"`
+	ID                string     `json:"id"`
+	Part              uint8      `json:"part"`
+	Title             string     `json:"title"`
+	Description       string     `json:"description"`
+	SubmissionClosed  bool       `json:"submission_closed"`
+	Submitted         bool       `json:"submitted"`
+	DueAt             *time.Time `json:"due_at"`
+	LatePolicy        LatePolicy `json:"late_policy"`
+	LatePenaltyPerDay int        `json:"late_penalty_per_day"`
+	LateDays          int        `json:"late_days"`
+	Late              bool       `json:"late"` // 遅延提出したかどうか
+	AllowedTypes      []string   `json:"allowed_types"`
 }
 
 // GetClasses GET /api/courses/:courseID/classes 科目に紐づく講義一覧の取得
@@ -1222,7 +1401,7 @@ func (h *handlers) GetClasses(c echo.Context) error {
 	}
 
 	var classes []ClassWithSubmitted
-	query := "SELECT `classes`.*, `submissions`.`user_id` IS NOT NULL AS `submitted`" +
+	query := "SELECT `classes`.*, `submissions`.`user_id` IS NOT NULL AS `submitted`, COALESCE(`submissions`.`late`, false) AS `late`" +
 		" FROM `classes`" +
 		" LEFT JOIN `submissions` ON `classes`.`id` = `submissions`.`class_id` AND `submissions`.`user_id` = ?" +
 		" WHERE `classes`.`course_id` = ?" +
@@ -1241,12 +1420,18 @@ func (h *handlers) GetClasses(c echo.Context) error {
 	res := make([]GetClassResponse, 0, len(classes))
 	for _, class := range classes {
 		res = append(res, GetClassResponse{
-			ID:               class.ID,
-			Part:             class.Part,
-			Title:            class.Title,
-			Description:      class.Description,
-			SubmissionClosed: class.SubmissionClosed,
-			Submitted:        class.Submitted,
+			ID:                class.ID,
+			Part:              class.Part,
+			Title:             class.Title,
+			Description:       class.Description,
+			SubmissionClosed:  class.SubmissionClosed,
+			Submitted:         class.Submitted,
+			DueAt:             class.DueAt,
+			LatePolicy:        class.LatePolicy,
+			LatePenaltyPerDay: class.LatePenaltyPerDay,
+			LateDays:          class.LateDays,
+			Late:              class.Late,
+			AllowedTypes:      class.allowedTypes(),
 		})
 	}
 
@@ -1254,9 +1439,14 @@ func (h *handlers) GetClasses(c echo.Context) error {
 }
 
 type AddClassRequest struct {
-	Part        uint8  `json:"part"`
-	Title       string `json:"title"`
-	Description string `json:"description"`
+	Part              uint8      `json:"part"`
+	Title             string     `json:"title"`
+	Description       string     `json:"description"`
+	DueAt             *time.Time `json:"due_at"`
+	LatePolicy        LatePolicy `json:"late_policy"`
+	LatePenaltyPerDay int        `json:"late_penalty_per_day"`
+	LateDays          int        `json:"late_days"`
+	AllowedTypes      []string   `json:"allowed_types"` // 省略した場合はPDFのみ
 }
 
 type AddClassResponse struct {
@@ -1273,6 +1463,19 @@ func (h *handlers) AddClass(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.String(http.StatusBadRequest, "Invalid format.")
 	}
+	if req.LatePolicy == "" {
+		req.LatePolicy = LateReject
+	}
+	if message := validateLatePolicy(req.LatePolicy, req.LatePenaltyPerDay, req.LateDays); message != "" {
+		return c.String(http.StatusBadRequest, message)
+	}
+	allowedTypes := defaultAllowedTypes
+	if req.AllowedTypes != nil {
+		if message := validateAllowedTypes(req.AllowedTypes); message != "" {
+			return c.String(http.StatusBadRequest, message)
+		}
+		allowedTypes = strings.Join(lo.Uniq(req.AllowedTypes), ",")
+	}
 
 	//tx, err := h.DB.BeginTxx(c.Request().Context(), nil)
 	//if err != nil {
@@ -1307,8 +1510,8 @@ func (h *handlers) AddClass(c echo.Context) error {
 	}
 
 	classID := newULID()
-	if _, err := db.ExecContext(c.Request().Context(), "INSERT INTO `classes` (`id`, `course_id`, `part`, `title`, `description`) VALUES (?, ?, ?, ?, ?)",
-		classID, courseID, req.Part, req.Title, req.Description); err != nil {
+	if _, err := db.ExecContext(c.Request().Context(), "INSERT INTO `classes` (`id`, `course_id`, `part`, `title`, `description`, `due_at`, `late_policy`, `late_penalty_per_day`, `late_days`, `allowed_types`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		classID, courseID, req.Part, req.Title, req.Description, req.DueAt, req.LatePolicy, req.LatePenaltyPerDay, req.LateDays, allowedTypes); err != nil {
 		//_ = tx.Rollback()
 		if pgxIsDuplicateError(err) {
 			var class Class
@@ -1343,6 +1546,7 @@ func (h *handlers) SubmitAssignment(c echo.Context) error {
 
 	courseID := c.Param("courseID")
 	classID := c.Param("classID")
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, submissionMaxBytes+submissionFormOverhead)
 
 	tx, err := h.DB.BeginTxx(c.Request().Context(), nil)
 	if err != nil {
@@ -1385,275 +1589,412 @@ func (h *handlers) SubmitAssignment(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	var submissionClosed bool
-	if err := tx.GetContext(c.Request().Context(), &submissionClosed, "SELECT `submission_closed` FROM `classes` WHERE `id` = ?", classID); err != nil && err != sql.ErrNoRows {
+	var class Class
+	if err := tx.GetContext(c.Request().Context(), &class, "SELECT * FROM `classes` WHERE `id` = ?", classID); err != nil && err != sql.ErrNoRows {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	} else if err == sql.ErrNoRows {
 		return c.String(http.StatusNotFound, "No such class.")
 	}
-	if submissionClosed {
+	if class.SubmissionClosed {
 		return c.String(http.StatusBadRequest, "Submission has been closed for this class.")
 	}
+	// 締切後に自動で締め切られるまでの間に提出された場合もここで弾く
+	late, penalty, ok := class.lateness(time.Now())
+	if !ok {
+		return c.String(http.StatusBadRequest, "The submission deadline has passed.")
+	}
 
 	file, header, err := c.Request().FormFile("file")
-	if err != nil {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("The file must be at most %d bytes.", submissionMaxBytes))
+	} else if err != nil {
 		return c.String(http.StatusBadRequest, "Invalid file.")
 	}
 	defer file.Close()
+	if header.Size > submissionMaxBytes {
+		return c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("The file must be at most %d bytes.", submissionMaxBytes))
+	}
+	if header.Size == 0 {
+		return c.String(http.StatusBadRequest, "The file is empty.")
+	}
 
-	if _, err := tx.ExecContext(c.Request().Context(), "INSERT INTO `submissions` (`user_id`, `class_id`, `file_name`) VALUES (?, ?, ?) ON CONFLICT(user_id, class_id) DO UPDATE SET `file_name` = EXCLUDED.file_name", userID, classID, header.Filename); err != nil {
+	data, err := io.ReadAll(file)
+	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	contentType := detectContentType(data)
+	if !lo.Contains(class.allowedTypes(), contentType) {
+		return c.String(http.StatusBadRequest, "Unsupported file type: "+contentType)
+	}
+	fileName := sanitizeFileName(header.Filename)
 
-	data, err := io.ReadAll(file)
-	if err != nil {
+	if _, err := tx.ExecContext(c.Request().Context(), "INSERT INTO `submissions` (`user_id`, `class_id`, `file_name`, `late`, `penalty`) VALUES (?, ?, ?, ?, ?)"+
+		" ON CONFLICT(user_id, class_id) DO UPDATE SET `file_name` = EXCLUDED.file_name, `late` = EXCLUDED.late, `penalty` = EXCLUDED.penalty",
+		userID, classID, fileName, late, penalty); err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	dst := AssignmentsDirectory + classID + "-" + userID + ".pdf"
-	if err := os.WriteFile(dst, data, 0o666); err != nil {
+	// 再提出しても前の提出ファイルは上書きせず、新しいバージョンとして保存する
+	version, storageKey, err := addSubmissionVersion(c.Request().Context(), tx, h.Blobs, userID, classID, fileName, contentType, data, late)
+	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	if err := tx.Commit(); err != nil {
 		c.Logger().Error(err)
+		if err := h.Blobs.Delete(context.WithoutCancel(c.Request().Context()), storageKey); err != nil {
+			c.Logger().Error(err)
+		}
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	ctx := c.Request().Context()
-	if err := rdb.Incr(ctx, "submissions:"+classID).Err(); err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+	if version == 1 {
+		if err := rdb.Incr(ctx, "submissions:"+classID).Err(); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
 	}
 
 	return c.NoContent(http.StatusNoContent)
 }
 
 type Score struct {
-	UserCode string `json:"user_code"`
-	Score    int    `json:"score"`
+	UserCode string           `json:"user_code"`
+	Score    int              `json:"score"`
+	Criteria []CriterionScore `json:"criteria"` // 指定した場合はscoreの代わりに採点基準から点数を求める
+	Feedback string           `json:"feedback"`
+}
+
+type RegisterScoresErrorResponse struct {
+	UnknownUser        []string `json:"unknown_user,omitempty"`
+	NotRegistered      []string `json:"not_registered,omitempty"`
+	OutOfRange         []string `json:"out_of_range,omitempty"`
+	DuplicateInRequest []string `json:"duplicate_in_request,omitempty"`
+	InvalidCriteria    []string `json:"invalid_criteria,omitempty"`
 }
 
 // RegisterScores PUT /api/courses/:courseID/classes/:classID/assignments/scores 採点結果登録
+// 1件でも不正な採点結果があれば何も登録せず、学生のコード毎のエラーを返す
 func (h *handlers) RegisterScores(c echo.Context) error {
+	courseID := c.Param("courseID")
 	classID := c.Param("classID")
 
-	//tx, err := h.DB.BeginTxx(c.Request().Context(), nil)
-	//if err != nil {
-	//	c.Logger().Error(err)
-	//	return c.NoContent(http.StatusInternalServerError)
-	//}
-	//defer tx.Rollback()
-
-	db := h.DB
-	type class struct {
-		SubmissionClosed bool   `db:"submission_closed"`
-		CourseID         string `db:"course_id"`
+	var req []Score
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
 	}
-	var cls class
-	if err := db.GetContext(c.Request().Context(), &cls, "SELECT course_id, `submission_closed` FROM `classes` WHERE `id` = ?", classID); err != nil && err != sql.ErrNoRows {
+
+	ctx := c.Request().Context()
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
-	} else if err == sql.ErrNoRows {
-		return c.String(http.StatusNotFound, "No such class.")
 	}
+	defer tx.Rollback()
 
-	if !cls.SubmissionClosed {
+	// 同じ講義の採点を直列化する。submissionsの行がまだない学生は FOR UPDATE でロックできず、
+	// 同時に採点すると両方が0点からの差分を合計点に加算してしまう
+	var submissionClosed bool
+	if err := tx.GetContext(ctx, &submissionClosed, "SELECT `submission_closed` FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR UPDATE", classID, courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such class.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !submissionClosed {
 		return c.String(http.StatusBadRequest, "This assignment is not closed yet.")
 	}
+	if len(req) == 0 {
+		return c.NoContent(http.StatusNoContent)
+	}
 
-	var req []Score
-	if err := c.Bind(&req); err != nil {
-		return c.String(http.StatusBadRequest, "Invalid format.")
+	rubric, err := getRubric(ctx, tx, classID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	if len(req) > 0 {
-		userCodes := lo.Map(req, func(score Score, _ int) string {
-			return score.UserCode
-		})
-		uqs, args, err := sqlx.In("SELECT id, code FROM users  WHERE code IN (?)", userCodes)
+	userCodes := lo.Uniq(lo.Map(req, func(score Score, _ int) string {
+		return score.UserCode
+	}))
+	uqs, args, err := sqlx.In("SELECT id, code FROM users WHERE code IN (?)", userCodes)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var users []User
+	if err := tx.SelectContext(ctx, &users, uqs, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	userMap := lo.Associate(users, func(user User) (string, string) {
+		return user.Code, user.ID
+	})
+
+	var registeredUserIDs []string
+	if len(users) > 0 {
+		rqs, args, err := sqlx.In("SELECT user_id FROM registrations WHERE course_id = ? AND user_id IN (?)", courseID, lo.Values(userMap))
 		if err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
-		var users []User
-		if err := db.SelectContext(c.Request().Context(), &users, uqs, args...); err != nil {
+		if err := tx.SelectContext(ctx, &registeredUserIDs, rqs, args...); err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
-		type submissionUpdates struct {
-			UserID  string `db:"user_id"`
-			Score   int    `db:"score"`
-			ClassID string `db:"class_id"`
+	}
+
+	var errs RegisterScoresErrorResponse
+	seen := make(map[string]bool, len(req))
+	for i, score := range req {
+		if seen[score.UserCode] {
+			errs.DuplicateInRequest = append(errs.DuplicateInRequest, score.UserCode)
+			continue
+		}
+		seen[score.UserCode] = true
+
+		userID, ok := userMap[score.UserCode]
+		if !ok {
+			errs.UnknownUser = append(errs.UnknownUser, score.UserCode)
+			continue
 		}
-		userMap := lo.Associate(users, func(user User) (string, string) {
-			return user.Code, user.ID
-		})
-		updates := lo.Map(req, func(score Score, _ int) submissionUpdates {
-			uid := userMap[score.UserCode]
-			rdb.IncrBy(c.Request().Context(), "course_total_scores:"+cls.CourseID+":"+uid, int64(score.Score))
-
-			return submissionUpdates{
-				UserID:  uid,
-				Score:   score.Score,
-				ClassID: classID,
+		if !lo.Contains(registeredUserIDs, userID) {
+			errs.NotRegistered = append(errs.NotRegistered, score.UserCode)
+			continue
+		}
+		if score.Criteria != nil {
+			total, message := scoreByRubric(rubric, score.Criteria)
+			if message != "" {
+				errs.InvalidCriteria = append(errs.InvalidCriteria, score.UserCode)
+				continue
+			}
+			req[i].Score = total
+		} else if score.Score < 0 || score.Score > 100 {
+			errs.OutOfRange = append(errs.OutOfRange, score.UserCode)
+		}
+	}
+	errs.DuplicateInRequest = lo.Uniq(errs.DuplicateInRequest)
+	if len(errs.UnknownUser) > 0 || len(errs.NotRegistered) > 0 || len(errs.OutOfRange) > 0 || len(errs.DuplicateInRequest) > 0 || len(errs.InvalidCriteria) > 0 {
+		return c.JSON(http.StatusBadRequest, errs)
+	}
+
+	// 遅延提出の減点を差し引いた点数を記録する
+	type submissionPenalty struct {
+		UserID  string `db:"user_id"`
+		Penalty int    `db:"penalty"`
+	}
+	var penalties []submissionPenalty
+	if err := tx.SelectContext(ctx, &penalties, "SELECT `user_id`, `penalty` FROM `submissions` WHERE `class_id` = ? AND `penalty` > 0", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	penaltyMap := lo.Associate(penalties, func(p submissionPenalty) (string, int) {
+		return p.UserID, p.Penalty
+	})
+
+	// 採点し直した場合に合計点へ加算する差分を求めるため、今の点数を取得する (講義の行をロック済みなので他の採点は反映されている)
+	type currentScore struct {
+		UserID string        `db:"user_id"`
+		Score  sql.NullInt16 `db:"score"`
+	}
+	sqs, args, err := sqlx.In("SELECT user_id, score FROM submissions WHERE class_id = ? AND user_id IN (?) FOR UPDATE", classID, lo.Values(userMap))
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var currentScores []currentScore
+	if err := tx.SelectContext(ctx, &currentScores, sqs, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	currentScoreMap := lo.Associate(currentScores, func(cs currentScore) (string, int) {
+		return cs.UserID, int(cs.Score.Int16)
+	})
+
+	type submissionUpdates struct {
+		UserID   string `db:"user_id"`
+		Score    int    `db:"score"`
+		ClassID  string `db:"class_id"`
+		Feedback string `db:"feedback"`
+	}
+	updates := lo.Map(req, func(score Score, _ int) submissionUpdates {
+		uid := userMap[score.UserCode]
+		return submissionUpdates{
+			UserID:   uid,
+			Score:    max(score.Score-penaltyMap[uid], 0),
+			ClassID:  classID,
+			Feedback: score.Feedback,
+		}
+	})
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO `submissions` (`user_id`, `class_id`, `score`, `file_name`, `feedback`) VALUES (:user_id, :class_id, :score, '', :feedback) ON CONFLICT(user_id, class_id) DO UPDATE SET `score` = EXCLUDED.score, `feedback` = EXCLUDED.feedback", updates); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	type criterionScoreUpdate struct {
+		UserID      string `db:"user_id"`
+		CriterionID string `db:"criterion_id"`
+		ClassID     string `db:"class_id"`
+		Points      int    `db:"points"`
+	}
+	criterionUpdates := lo.FlatMap(req, func(score Score, _ int) []criterionScoreUpdate {
+		return lo.Map(score.Criteria, func(cs CriterionScore, _ int) criterionScoreUpdate {
+			return criterionScoreUpdate{
+				UserID:      userMap[score.UserCode],
+				CriterionID: cs.CriterionID,
+				ClassID:     classID,
+				Points:      cs.Points,
 			}
 		})
-		ctx := c.Request().Context()
-		if _, err := db.NamedExecContext(ctx, "INSERT INTO `submissions` (`user_id`, `class_id`, `score`, `file_name`) VALUES (:user_id, :class_id, :score, '') ON CONFLICT(user_id, class_id) DO UPDATE SET `score` = EXCLUDED.score", updates); err != nil {
+	})
+	// 採点基準を指定せずに採点し直した学生は、前の基準ごとの得点が新しい点数と合わなくなるので消す
+	plainUserIDs := lo.FilterMap(req, func(score Score, _ int) (string, bool) {
+		return userMap[score.UserCode], score.Criteria == nil
+	})
+	if len(plainUserIDs) > 0 {
+		dqs, args, err := sqlx.In("DELETE FROM `criterion_scores` WHERE `class_id` = ? AND `user_id` IN (?)", classID, plainUserIDs)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if _, err := tx.ExecContext(ctx, dqs, args...); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	if len(criterionUpdates) > 0 {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO `criterion_scores` (`user_id`, `criterion_id`, `class_id`, `points`) VALUES (:user_id, :criterion_id, :class_id, :points) ON CONFLICT(user_id, criterion_id) DO UPDATE SET `points` = EXCLUDED.points", criterionUpdates); err != nil {
 			c.Logger().Error(err)
 			return c.NoContent(http.StatusInternalServerError)
 		}
 	}
 
-	//if err := tx.Commit(); err != nil {
-	//	c.Logger().Error(err)
-	//	return c.NoContent(http.StatusInternalServerError)
-	//}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// ロールバックした場合に合計点のキャッシュがずれないよう、コミット後に差分のみ反映する。
+	// 差分の加算は順序によらないので、同時に採点されても結果は変わらない
+	deltas := make(map[string]int, len(updates))
+	for _, update := range updates {
+		deltas[update.UserID] = update.Score - currentScoreMap[update.UserID]
+	}
+	if err := applyCourseTotalScoreDeltas(ctx, courseID, deltas); err != nil {
+		// DBには反映済みなので、ずれは reconcile-scores で直す
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
 	return c.NoContent(http.StatusNoContent)
 }
 
 type Submission struct {
-	UserID   string `db:"user_id"`
-	UserCode string `db:"user_code"`
-	FileName string `db:"file_name"`
+	ID          string `db:"id"`
+	UserID      string `db:"user_id"`
+	UserCode    string `db:"user_code"`
+	FileName    string `db:"file_name"`
+	ContentType string `db:"content_type"`
+	Version     int    `db:"version"`
+	StorageKey  string `db:"storage_key"`
 }
 
 // DownloadSubmittedAssignments GET /api/courses/:courseID/classes/:classID/assignments/export 提出済みの課題ファイルをzip形式で一括ダウンロード
+// 各学生の最新の提出のみを含める。all=true の場合は全てのバージョンを含める
 func (h *handlers) DownloadSubmittedAssignments(c echo.Context) error {
+	courseID := c.Param("courseID")
 	classID := c.Param("classID")
-
-	tx, err := h.DB.BeginTxx(c.Request().Context(), nil)
-	if err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-	defer tx.Rollback()
+	all, _ := strconv.ParseBool(c.QueryParam("all"))
 
 	var classCount int
-	if err := tx.GetContext(c.Request().Context(), &classCount, "SELECT 1 FROM `classes` WHERE `id` = ? FOR UPDATE", classID); errors.Is(err, sql.ErrNoRows) {
+	if err := h.DB.GetContext(c.Request().Context(), &classCount, "SELECT 1 FROM `classes` WHERE `id` = ? AND `course_id` = ?", classID, courseID); errors.Is(err, sql.ErrNoRows) {
 		return c.String(http.StatusNotFound, "No such class.")
 	} else if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	var submissions []Submission
-	query := "SELECT `submissions`.`user_id`, `submissions`.`file_name`, `users`.`code` AS `user_code`" +
-		" FROM `submissions`" +
-		" JOIN `users` ON `users`.`id` = `submissions`.`user_id`" +
-		" WHERE `class_id` = ?"
-	if err := tx.SelectContext(c.Request().Context(), &submissions, query, classID); err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	zipFilePath := AssignmentsDirectory + classID + ".zip"
-	//if err := createSubmissionsZip(zipFilePath, classID, submissions); err != nil {
-	//	c.Logger().Error(err)
-	//	return c.NoContent(http.StatusInternalServerError)
-	//}
-
-	buf, err := createSubmissionsZipOnMemory(zipFilePath, classID, submissions)
+	submissions, err := getSubmissionsForExport(c.Request().Context(), h.DB, classID, all)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	if _, err := tx.ExecContext(c.Request().Context(), "UPDATE `classes` SET `submission_closed` = true WHERE `id` = ?", classID); err != nil {
+	// zip全体をメモリに載せないよう、レスポンスに直接書き出す
+	c.Response().Header().Set(echo.HeaderContentType, "application/zip")
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", classID+".zip"))
+	c.Response().WriteHeader(http.StatusOK)
+	if err := writeSubmissionsZip(c.Request().Context(), c.Response(), h.Blobs, submissions, all); err != nil {
+		// ステータスコードは送信済みなので、途中で切れたzipとしてクライアントに検知させる
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	if err := tx.Commit(); err != nil {
-		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
+	return nil
+}
 
-	return c.Blob(200, "application/zip", buf)
+// getSubmissionsForExport zipに含める提出ファイル。all=false の場合は各学生の最新の提出のみ
+func getSubmissionsForExport(ctx context.Context, db sqlx.QueryerContext, classID string, all bool) ([]Submission, error) {
+	var submissions []Submission
+	query := "SELECT"
+	if !all {
+		query += " DISTINCT ON (`submission_versions`.`user_id`)"
+	}
+	query += " `submission_versions`.`id`, `submission_versions`.`user_id`, `submission_versions`.`file_name`, `submission_versions`.`content_type`," +
+		" `submission_versions`.`version`, `submission_versions`.`storage_key`, `users`.`code` AS `user_code`" +
+		" FROM `submission_versions`" +
+		" JOIN `users` ON `users`.`id` = `submission_versions`.`user_id`" +
+		" WHERE `submission_versions`.`class_id` = ?" +
+		" ORDER BY `submission_versions`.`user_id`, `submission_versions`.`version` DESC"
+	if err := sqlx.SelectContext(ctx, db, &submissions, query, classID); err != nil {
+		return nil, err
+	}
+	return submissions, nil
 }
 
-//func createSubmissionsZip(zipFilePath string, classID string, submissions []Submission) error {
-//	tmpDir := AssignmentsDirectory + classID + "/"
-//	if err := exec.Command("rm", "-rf", tmpDir).Run(); err != nil {
-//		return err
-//	}
-//	if err := exec.Command("mkdir", tmpDir).Run(); err != nil {
-//		return err
-//	}
-//
-//	// ファイル名を指定の形式に変更
-//	for _, submission := range submissions {
-//		if err := exec.Command(
-//			"cp",
-//			AssignmentsDirectory+classID+"-"+submission.UserID+".pdf",
-//			tmpDir+submission.UserCode+"-"+submission.FileName,
-//		).Run(); err != nil {
-//			return err
-//		}
-//	}
-//
-//	// -i 'tmpDir/*': 空zipを許す
-//	return exec.Command("zip", "-j", "-r", zipFilePath, tmpDir, "-i", tmpDir+"*").Run()
-//}
-
-func createSubmissionsZipOnMemory(zipFilePath string, classID string, submissions []Submission) ([]byte, error) {
-	//tmpDir := AssignmentsDirectory + classID + "/"
-	//if err := exec.Command("rm", "-rf", tmpDir).Run(); err != nil {
-	//	return nil, err
-	//}
-	//if err := exec.Command("mkdir", tmpDir).Run(); err != nil {
-	//	return nil, err
-	//}
+// zipEntryName zip内のファイル名を指定の形式にする
+// 移行前の提出のファイル名はサニタイズされていないので、ここでも取り除く
+func (s Submission) zipEntryName(all bool) string {
+	if all {
+		return fmt.Sprintf("%v-v%v-%v", s.UserCode, s.Version, sanitizeFileName(s.FileName))
+	}
+	return s.UserCode + "-" + sanitizeFileName(s.FileName)
+}
 
-	buf := &bytes.Buffer{}
-	zw := zip.NewWriter(buf)
-	// ファイル名を指定の形式に変更
+func writeSubmissionsZip(ctx context.Context, w io.Writer, blobs BlobStore, submissions []Submission, all bool) error {
+	zw := zip.NewWriter(w)
 	for _, submission := range submissions {
-		f, err := os.Open(AssignmentsDirectory + classID + "-" + submission.UserID + ".pdf")
-		if err != nil {
-			return nil, err
-		}
-
-		// ZIPファイルにファイルエントリを追加
-		zipFile, err := zw.CreateHeader(
-			&zip.FileHeader{
-				Name:   submission.UserCode + "-" + submission.FileName,
-				Method: zip.Store,
-			},
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		// ファイルの内容をZIPにコピー
-		_, err = io.Copy(zipFile, f)
-		if err != nil {
-			return nil, err
+		if err := writeZipEntry(ctx, zw, blobs, submission.StorageKey, submission.zipEntryName(all)); err != nil {
+			return err
 		}
+	}
+	return zw.Close()
+}
 
-		//if err := exec.Command(
-		//	"cp",
-		//	AssignmentsDirectory+classID+"-"+submission.UserID+".pdf",
-		//	tmpDir+submission.UserCode+"-"+submission.FileName,
-		//).Run(); err != nil {
-		//	return err
-		//}
-
-		f.Close()
+func writeZipEntry(ctx context.Context, zw *zip.Writer, blobs BlobStore, key string, name string) error {
+	f, err := blobs.Open(ctx, key)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	err := zw.Close()
+	// ZIPファイルにファイルエントリを追加
+	zipFile, err := zw.CreateHeader(
+		&zip.FileHeader{
+			Name:   name,
+			Method: zip.Store,
+		},
+	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// -i 'tmpDir/*': 空zipを許す
-	// return exec.Command("zip", "-j", "-r", zipFilePath, tmpDir, "-i", tmpDir+"*").Run()
-	return buf.Bytes(), nil
+	// ファイルの内容をZIPにコピー
+	_, err = io.Copy(zipFile, f)
+	return err
 }
 
 // ---------- Announcement API ----------
@@ -1694,8 +2035,8 @@ func (h *handlers) GetAnnouncementList(c echo.Context) error {
 		" JOIN `courses` ON `announcements`.`course_id` = `courses`.`id`" +
 		" JOIN `registrations` ON `courses`.`id` = `registrations`.`course_id`" +
 		" LEFT JOIN `unread_announcements` ON `announcements`.`id` = `unread_announcements`.`announcement_id` AND unread_announcements.user_id = ?" +
-		" WHERE 1=1"
-	args = append(args, userID)
+		" WHERE (`announcements`.`target_user_id` IS NULL OR `announcements`.`target_user_id` = ?)"
+	args = append(args, userID, userID)
 
 	if courseID := c.QueryParam("course_id"); courseID != "" {
 		query += " AND `announcements`.`course_id` = ?"
@@ -1773,10 +2114,11 @@ func (h *handlers) GetAnnouncementList(c echo.Context) error {
 }
 
 type Announcement struct {
-	ID       string `db:"id"`
-	CourseID string `db:"course_id"`
-	Title    string `db:"title"`
-	Message  string `db:"message"`
+	ID           string         `db:"id"`
+	CourseID     string         `db:"course_id"`
+	Title        string         `db:"title"`
+	Message      string         `db:"message"`
+	TargetUserID sql.NullString `db:"target_user_id"`
 }
 
 type AddAnnouncementRequest struct {
@@ -1795,6 +2137,11 @@ func (h *handlers) AddAnnouncement(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid format.")
 	}
 
+	// 対象の科目がリクエストボディで指定されるため、middlewareではなくここで権限を確認する
+	if ok, err := h.authorizeCourse(c, PermAddAnnouncement, req.CourseID); !ok {
+		return err
+	}
+
 	tx, err := h.DB.BeginTxx(c.Request().Context(), nil)
 	if err != nil {
 		c.Logger().Error(err)
@@ -1894,8 +2241,8 @@ func (h *handlers) GetAnnouncementDetail(c echo.Context) error {
 		" FROM `announcements`" +
 		" JOIN `courses` ON `courses`.`id` = `announcements`.`course_id`" +
 		" LEFT JOIN `unread_announcements` ON `unread_announcements`.`announcement_id` = `announcements`.`id` AND unread_announcements.user_id = ?" +
-		" WHERE `announcements`.`id` = ?"
-	if err := h.DB.GetContext(c.Request().Context(), &announcement, query, userID, announcementID); err != nil && err != sql.ErrNoRows {
+		" WHERE `announcements`.`id` = ? AND (`announcements`.`target_user_id` IS NULL OR `announcements`.`target_user_id` = ?)"
+	if err := h.DB.GetContext(c.Request().Context(), &announcement, query, userID, announcementID, userID); err != nil && err != sql.ErrNoRows {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	} else if err == sql.ErrNoRows {
@@ -10,7 +10,8 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
-var rdb = GetRedisClient(context.Background())
+// rdb main で接続する (テストのバイナリではRedisに接続しない)
+var rdb *redis.Client
 
 func GetRedisClient(ctx context.Context) *redis.Client {
 	// redis.confで外部接続許可を忘れずに
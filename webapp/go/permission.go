@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+type Permission string
+
+const (
+	PermAddCourse            Permission = "add-course"
+	PermEditCourse           Permission = "edit-course"
+	PermSetCourseStatus      Permission = "set-course-status"
+	PermAddClass             Permission = "add-class"
+	PermEditClass            Permission = "edit-class"
+	PermCloseAssignments     Permission = "close-assignments"
+	PermRegisterScores       Permission = "register-scores"
+	PermExportAssignments    Permission = "export-assignments"
+	PermAddAnnouncement      Permission = "add-announcement"
+	PermManageCourseGrants   Permission = "manage-course-grants"
+	PermManageCourseTeachers Permission = "manage-course-teachers"
+	PermRevokeSessions       Permission = "revoke-sessions"
+	PermManageTerms          Permission = "manage-terms"
+	PermManageGradingScales  Permission = "manage-grading-scales"
+	PermViewCourseGrades     Permission = "view-course-grades"
+)
+
+const forbiddenMessage = "You do not have permission."
+
+// courseTeacherPermissions 担当教員(courses.teacher_id)と共同担当教員(course_teachers)が自分の科目に対して持つ権限
+var courseTeacherPermissions = []Permission{
+	PermEditCourse,
+	PermSetCourseStatus,
+	PermAddClass,
+	PermEditClass,
+	PermCloseAssignments,
+	PermRegisterScores,
+	PermExportAssignments,
+	PermViewCourseGrades,
+	PermAddAnnouncement,
+	PermManageCourseGrants,
+	PermManageCourseTeachers,
+}
+
+// userTypePermissions users.typeに対して全科目で与えられる権限
+var userTypePermissions = map[UserType][]Permission{
+	Student:           {},
+	TeachingAssistant: {},
+	Teacher:           {PermAddCourse},
+	DepartmentAdmin:   append([]Permission{PermAddCourse, PermRevokeSessions, PermManageTerms, PermManageGradingScales}, courseTeacherPermissions...),
+}
+
+// courseRolePermissions 科目毎の役割に対して与えられる権限
+var courseRolePermissions = map[UserType][]Permission{
+	TeachingAssistant: {PermCloseAssignments, PermRegisterScores, PermExportAssignments},
+	Teacher:           courseTeacherPermissions,
+}
+
+func getUserType(c echo.Context) (UserType, error) {
+	sess, err := session.Get(SessionName, c)
+	if err != nil {
+		return "", err
+	}
+	userType, ok := sess.Values["userType"].(string)
+	if !ok {
+		return "", errors.New("failed to get userType from session")
+	}
+	return UserType(userType), nil
+}
+
+// hasPermission courseIDが空の場合はusers.typeによる権限のみを確認する
+func (h *handlers) hasPermission(c echo.Context, perm Permission, courseID string) (bool, error) {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		return false, err
+	}
+	userType, err := getUserType(c)
+	if err != nil {
+		return false, err
+	}
+	if lo.Contains(userTypePermissions[userType], perm) {
+		return true, nil
+	}
+	if courseID == "" {
+		return false, nil
+	}
+
+	var roles []UserType
+	query := "SELECT 'teacher' AS `role` FROM `courses` WHERE `id` = ? AND `teacher_id` = ?" +
+		" UNION ALL SELECT 'teacher' AS `role` FROM `course_teachers` WHERE `course_id` = ? AND `user_id` = ?" +
+		" UNION ALL SELECT `role` FROM `course_grants` WHERE `course_id` = ? AND `user_id` = ?"
+	if err := h.DB.SelectContext(c.Request().Context(), &roles, query, courseID, userID, courseID, userID, courseID, userID); err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if lo.Contains(courseRolePermissions[role], perm) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authorizeCourse 許可されなかった場合は403(科目が存在しなければ404)のレスポンスを書き込んでfalseを返す
+func (h *handlers) authorizeCourse(c echo.Context, perm Permission, courseID string) (bool, error) {
+	ok, err := h.hasPermission(c, perm, courseID)
+	if err != nil {
+		c.Logger().Error(err)
+		return false, c.NoContent(http.StatusInternalServerError)
+	}
+	if ok {
+		return true, nil
+	}
+	if courseID != "" {
+		var count int
+		if err := h.DB.GetContext(c.Request().Context(), &count, "SELECT 1 FROM `courses` WHERE `id` = ?", courseID); errors.Is(err, sql.ErrNoRows) {
+			return false, c.String(http.StatusNotFound, "No such course.")
+		} else if err != nil {
+			c.Logger().Error(err)
+			return false, c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	return false, c.String(http.StatusForbidden, forbiddenMessage)
+}
+
+// Authorize 権限確認用middleware。ルートに:courseIDがあればその科目の担当教員・付与された役割も考慮する
+func (h *handlers) Authorize(perm Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if ok, err := h.authorizeCourse(c, perm, c.Param("courseID")); !ok {
+				return err
+			}
+
+			return next(c)
+		}
+	}
+}
+
+type CourseGrant struct {
+	UserCode string   `json:"user_code" db:"user_code"`
+	UserName string   `json:"user_name" db:"user_name"`
+	Role     UserType `json:"role" db:"role"`
+}
+
+// GetCourseGrants GET /api/courses/:courseID/grants 科目毎の権限付与一覧
+func (h *handlers) GetCourseGrants(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	grants := make([]CourseGrant, 0)
+	query := "SELECT `users`.`code` AS `user_code`, `users`.`name` AS `user_name`, `course_grants`.`role`" +
+		" FROM `course_grants`" +
+		" JOIN `users` ON `users`.`id` = `course_grants`.`user_id`" +
+		" WHERE `course_grants`.`course_id` = ?" +
+		" ORDER BY `users`.`code`"
+	if err := h.DB.SelectContext(c.Request().Context(), &grants, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, grants)
+}
+
+type PutCourseGrantRequest struct {
+	UserCode string   `json:"user_code"`
+	Role     UserType `json:"role"`
+}
+
+// PutCourseGrant PUT /api/courses/:courseID/grants 科目毎の権限付与
+func (h *handlers) PutCourseGrant(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var req PutCourseGrantRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if req.Role != TeachingAssistant {
+		return c.String(http.StatusBadRequest, "Invalid role.")
+	}
+
+	var count int
+	if err := h.DB.GetContext(c.Request().Context(), &count, "SELECT 1 FROM `courses` WHERE `id` = ?", courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such course.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var userID string
+	if err := h.DB.GetContext(c.Request().Context(), &userID, "SELECT `id` FROM `users` WHERE `code` = ?", req.UserCode); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such user.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if _, err := h.DB.ExecContext(c.Request().Context(), "INSERT INTO `course_grants` (`course_id`, `user_id`, `role`) VALUES (?, ?, ?) ON CONFLICT(course_id, user_id) DO UPDATE SET `role` = EXCLUDED.role",
+		courseID, userID, req.Role); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// DeleteCourseGrant DELETE /api/courses/:courseID/grants/:userCode 科目毎の権限剥奪
+func (h *handlers) DeleteCourseGrant(c echo.Context) error {
+	courseID := c.Param("courseID")
+	userCode := c.Param("userCode")
+
+	result, err := h.DB.ExecContext(c.Request().Context(), "DELETE FROM `course_grants` WHERE `course_id` = ? AND `user_id` = (SELECT `id` FROM `users` WHERE `code` = ?)", courseID, userCode)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	ra, err := result.RowsAffected()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if ra == 0 {
+		return c.String(http.StatusNotFound, "No such grant.")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
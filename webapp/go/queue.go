@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// runQueueWorker RedisのリストをキューとしてIDを取り出し、processで処理し続ける。
+// 処理に失敗したIDはログに出して捨てる
+func runQueueWorker(ctx context.Context, logger echo.Logger, queueKey string, process func(ctx context.Context, id string) error) {
+	for {
+		res, err := rdb.BRPop(ctx, 0, queueKey).Result()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error(err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if err := process(ctx, res[1]); err != nil {
+			logger.Error(err)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+// creditLimit 1学期に履修できる単位数の上限。0の場合は上限なし
+var creditLimit, _ = strconv.Atoi(GetEnv("CREDIT_LIMIT_PER_TERM", "0"))
+
+// checkPrerequisites 前提科目を満たしていない科目のIDを返す。
+// 前提科目は修了(closed)済みで、その科目の課題の合計点がmin_score以上である必要がある
+func checkPrerequisites(ctx context.Context, tx *sqlx.Tx, userID string, courseIDs []string) ([]string, error) {
+	if len(courseIDs) == 0 {
+		return nil, nil
+	}
+
+	query := "SELECT DISTINCT `course_prerequisites`.`course_id`" +
+		" FROM `course_prerequisites`" +
+		" WHERE `course_prerequisites`.`course_id` IN (?) AND NOT EXISTS (" +
+		"     SELECT 1" +
+		"     FROM `registrations`" +
+		"     JOIN `courses` ON `courses`.`id` = `registrations`.`course_id` AND `courses`.`status` = ?" +
+		"     WHERE `registrations`.`user_id` = ? AND `registrations`.`course_id` = `course_prerequisites`.`required_course_id`" +
+		"     AND (" +
+		"         SELECT COALESCE(SUM(`submissions`.`score`), 0)" +
+		"         FROM `classes`" +
+		"         JOIN `submissions` ON `submissions`.`class_id` = `classes`.`id` AND `submissions`.`user_id` = `registrations`.`user_id`" +
+		"         WHERE `classes`.`course_id` = `courses`.`id`" +
+		"     ) >= `course_prerequisites`.`min_score`" +
+		" )" +
+		" ORDER BY `course_prerequisites`.`course_id`"
+	query, args, err := sqlx.In(query, courseIDs, StatusClosed, userID)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	if err := tx.SelectContext(ctx, &missing, query, args...); err != nil {
+		return nil, err
+	}
+	return missing, nil
+}
+
+// checkCreditLimit 学期毎に、履修中の科目に新規の科目をID順に加えていき、上限を超える科目のIDを返す
+func checkCreditLimit(registered []Course, newlyAdded []Course) []string {
+	if creditLimit <= 0 {
+		return nil
+	}
+
+	credits := make(map[string]int)
+	for _, course := range registered {
+		credits[termKey(course.TermID)] += int(course.Credit)
+	}
+	var exceeded []string
+	for _, course := range newlyAdded {
+		term := termKey(course.TermID)
+		if credits[term]+int(course.Credit) > creditLimit {
+			exceeded = append(exceeded, course.ID)
+			continue
+		}
+		credits[term] += int(course.Credit)
+	}
+	return exceeded
+}
+
+type CoursePrerequisite struct {
+	CourseID string `json:"course_id" db:"required_course_id"`
+	Code     string `json:"code" db:"code"`
+	Name     string `json:"name" db:"name"`
+	MinScore int    `json:"min_score" db:"min_score"`
+}
+
+// GetCoursePrerequisites GET /api/courses/:courseID/prerequisites 前提科目一覧
+func (h *handlers) GetCoursePrerequisites(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	prerequisites := make([]CoursePrerequisite, 0)
+	query := "SELECT `course_prerequisites`.`required_course_id`, `courses`.`code`, `courses`.`name`, `course_prerequisites`.`min_score`" +
+		" FROM `course_prerequisites`" +
+		" JOIN `courses` ON `courses`.`id` = `course_prerequisites`.`required_course_id`" +
+		" WHERE `course_prerequisites`.`course_id` = ?" +
+		" ORDER BY `courses`.`code`"
+	if err := h.DB.SelectContext(c.Request().Context(), &prerequisites, query, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, prerequisites)
+}
+
+type SetCoursePrerequisiteRequestContent struct {
+	CourseID string `json:"course_id"`
+	MinScore int    `json:"min_score"`
+}
+
+// SetCoursePrerequisites PUT /api/courses/:courseID/prerequisites 前提科目の設定(全件置き換え)
+func (h *handlers) SetCoursePrerequisites(c echo.Context) error {
+	courseID := c.Param("courseID")
+
+	var req []SetCoursePrerequisiteRequestContent
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	for _, p := range req {
+		if p.CourseID == courseID || p.MinScore < 0 {
+			return c.String(http.StatusBadRequest, "Invalid prerequisite.")
+		}
+	}
+	if len(lo.UniqBy(req, func(p SetCoursePrerequisiteRequestContent) string { return p.CourseID })) != len(req) {
+		return c.String(http.StatusBadRequest, "Duplicate prerequisite.")
+	}
+
+	tx, err := h.DB.BeginTxx(c.Request().Context(), nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.GetContext(c.Request().Context(), &count, "SELECT 1 FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such course.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if len(req) > 0 {
+		query, args, err := sqlx.In("SELECT COUNT(*) FROM `courses` WHERE `id` IN (?)", lo.Map(req, func(p SetCoursePrerequisiteRequestContent, _ int) string {
+			return p.CourseID
+		}))
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if err := tx.GetContext(c.Request().Context(), &count, query, args...); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if count != len(req) {
+			return c.String(http.StatusBadRequest, "No such prerequisite course.")
+		}
+	}
+
+	// 別の科目の前提条件の同時更新で循環ができないよう、更新を直列化する (読み取りは妨げない)
+	if _, err := tx.ExecContext(c.Request().Context(), "LOCK TABLE `course_prerequisites` IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := tx.ExecContext(c.Request().Context(), "DELETE FROM `course_prerequisites` WHERE `course_id` = ?", courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for _, p := range req {
+		if _, err := tx.ExecContext(c.Request().Context(), "INSERT INTO `course_prerequisites` (`course_id`, `required_course_id`, `min_score`) VALUES (?, ?, ?)",
+			courseID, p.CourseID, p.MinScore); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	// 前提科目を辿って自分自身に戻る場合は、どの科目も履修できなくなる
+	var cyclic bool
+	query := "WITH RECURSIVE `reachable` (`id`) AS (" +
+		" SELECT `required_course_id` FROM `course_prerequisites` WHERE `course_id` = ?" +
+		" UNION" +
+		" SELECT `course_prerequisites`.`required_course_id` FROM `course_prerequisites` JOIN `reachable` ON `course_prerequisites`.`course_id` = `reachable`.`id`" +
+		")" +
+		" SELECT EXISTS (SELECT 1 FROM `reachable` WHERE `id` = ?)"
+	if err := tx.GetContext(c.Request().Context(), &cyclic, query, courseID, courseID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if cyclic {
+		return c.String(http.StatusBadRequest, "Prerequisites must not be cyclic.")
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+type RubricCriterion struct {
+	ID          string `json:"id" db:"id"`
+	ClassID     string `json:"-" db:"class_id"`
+	Position    int    `json:"position" db:"position"`
+	Title       string `json:"title" db:"title"`
+	Description string `json:"description" db:"description"`
+	MaxPoints   int    `json:"max_points" db:"max_points"`
+}
+
+type CriterionScore struct {
+	CriterionID string `json:"criterion_id" db:"criterion_id"`
+	Points      int    `json:"points" db:"points"`
+}
+
+func getRubric(ctx context.Context, db sqlx.QueryerContext, classID string) ([]RubricCriterion, error) {
+	criteria := make([]RubricCriterion, 0)
+	if err := sqlx.SelectContext(ctx, db, &criteria, "SELECT * FROM `rubric_criteria` WHERE `class_id` = ? ORDER BY `position`", classID); err != nil {
+		return nil, err
+	}
+	return criteria, nil
+}
+
+// scoreByRubric 採点基準ごとの得点から100点満点の点数を求める。エラーの場合はレスポンスのメッセージを返す
+func scoreByRubric(criteria []RubricCriterion, scores []CriterionScore) (int, string) {
+	if len(criteria) == 0 {
+		return 0, "This class has no rubric."
+	}
+	pointsMap := make(map[string]int, len(scores))
+	for _, s := range scores {
+		if _, ok := pointsMap[s.CriterionID]; ok {
+			return 0, "Duplicate criterion: " + s.CriterionID
+		}
+		pointsMap[s.CriterionID] = s.Points
+	}
+	if len(pointsMap) != len(criteria) {
+		return 0, "All criteria of the rubric must be scored."
+	}
+
+	var points, maxPoints int
+	for _, criterion := range criteria {
+		p, ok := pointsMap[criterion.ID]
+		if !ok {
+			return 0, "All criteria of the rubric must be scored."
+		}
+		if p < 0 || p > criterion.MaxPoints {
+			return 0, "Invalid points for criterion: " + criterion.ID
+		}
+		points += p
+		maxPoints += criterion.MaxPoints
+	}
+	return int(math.Round(float64(points) * 100 / float64(maxPoints))), ""
+}
+
+// GetRubric GET /api/courses/:courseID/classes/:classID/rubric 講義の採点基準
+func (h *handlers) GetRubric(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+	ctx := c.Request().Context()
+
+	var classCount int
+	if err := h.DB.GetContext(ctx, &classCount, "SELECT 1 FROM `classes` WHERE `id` = ? AND `course_id` = ?", classID, courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such class.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	criteria, err := getRubric(ctx, h.DB, classID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, criteria)
+}
+
+type PutRubricCriterionRequest struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	MaxPoints   int    `json:"max_points"`
+}
+
+// PutRubric PUT /api/courses/:courseID/classes/:classID/rubric 講義の採点基準の設定
+// 指定した順に基準を置き換える。基準ごとの採点をした後は変更できない
+func (h *handlers) PutRubric(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	var req []PutRubricCriterionRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	for _, criterion := range req {
+		if criterion.Title == "" {
+			return c.String(http.StatusBadRequest, "Invalid title.")
+		}
+		if criterion.MaxPoints <= 0 || criterion.MaxPoints > math.MaxInt16 {
+			return c.String(http.StatusBadRequest, "Invalid max points.")
+		}
+	}
+
+	ctx := c.Request().Context()
+	tx, err := h.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var classCount int
+	if err := tx.GetContext(ctx, &classCount, "SELECT 1 FROM `classes` WHERE `id` = ? AND `course_id` = ? FOR UPDATE", classID, courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such class.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var scoredCount int
+	if err := tx.GetContext(ctx, &scoredCount, "SELECT COUNT(*) FROM `criterion_scores` WHERE `class_id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if scoredCount > 0 {
+		return c.String(http.StatusConflict, "Submissions have already been scored with the rubric.")
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM `rubric_criteria` WHERE `class_id` = ?", classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	criteria := lo.Map(req, func(r PutRubricCriterionRequest, i int) RubricCriterion {
+		return RubricCriterion{
+			ID:          newULID(),
+			ClassID:     classID,
+			Position:    i + 1,
+			Title:       r.Title,
+			Description: r.Description,
+			MaxPoints:   r.MaxPoints,
+		}
+	})
+	if len(criteria) > 0 {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO `rubric_criteria` (`id`, `class_id`, `position`, `title`, `description`, `max_points`) VALUES (:id, :class_id, :position, :title, :description, :max_points)", criteria); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, criteria)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+// 科目毎の学生の合計点は course_total_scores:<courseID>:<userID> としてRedisにキャッシュしている。
+// 採点時はコミット後に差分のみ加算するので、Redisへの反映に失敗した場合は reconcile-scores で直す
+
+type courseTotalScore struct {
+	UserID     string `db:"user_id"`
+	TotalScore int    `db:"total_score"`
+	CourseID   string `db:"course_id"`
+}
+
+func courseTotalScoreKey(courseID, userID string) string {
+	return "course_total_scores:" + courseID + ":" + userID
+}
+
+// computeCourseTotalScores submissionsから全ての履修の合計点を求める
+func computeCourseTotalScores(ctx context.Context, db sqlx.QueryerContext) ([]courseTotalScore, error) {
+	var totalScores []courseTotalScore
+	query := "SELECT users.id AS user_id, courses.id AS course_id, COALESCE(SUM(`submissions`.`score`), 0) AS `total_score`" +
+		" FROM `users`" +
+		" JOIN `registrations` ON `users`.`id` = `registrations`.`user_id`" +
+		" JOIN `courses` ON `registrations`.`course_id` = `courses`.`id`" +
+		" LEFT JOIN `classes` ON `courses`.`id` = `classes`.`course_id`" +
+		" LEFT JOIN `submissions` ON `users`.`id` = `submissions`.`user_id` AND `submissions`.`class_id` = `classes`.`id`" +
+		" GROUP BY `users`.`id`, `courses`.`id`"
+	if err := sqlx.SelectContext(ctx, db, &totalScores, query); err != nil {
+		return nil, err
+	}
+	return totalScores, nil
+}
+
+// getCourseTotalScores 学生毎の合計点をRedisから取得する。キャッシュがない学生は0点とする
+func getCourseTotalScores(ctx context.Context, courseID string, userIDs []string) ([]int, error) {
+	totals := make([]int, 0, len(userIDs))
+	if len(userIDs) == 0 {
+		return totals, nil
+	}
+	keys := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		keys = append(keys, courseTotalScoreKey(courseID, userID))
+	}
+	values, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		if value == nil {
+			totals = append(totals, 0)
+			continue
+		}
+		total, err := strconv.Atoi(value.(string))
+		if err != nil {
+			return nil, err
+		}
+		totals = append(totals, total)
+	}
+	return totals, nil
+}
+
+// applyCourseTotalScoreDeltas 学生毎の合計点の差分を加算する。DBのコミット後に呼ぶこと
+func applyCourseTotalScoreDeltas(ctx context.Context, courseID string, deltas map[string]int) error {
+	_, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for userID, delta := range deltas {
+			if delta != 0 {
+				pipe.IncrBy(ctx, courseTotalScoreKey(courseID, userID), int64(delta))
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+const reconcileBatchSize = 1000
+
+// reconcileCourseTotalScores Redisの合計点をDBから求め直した値と比較し、ずれているものを書き出す。
+// dryRunでなければ正しい値で上書きする
+func reconcileCourseTotalScores(ctx context.Context, db sqlx.QueryerContext, w io.Writer, dryRun bool) (int, error) {
+	totalScores, err := computeCourseTotalScores(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	drifted := 0
+	for start := 0; start < len(totalScores); start += reconcileBatchSize {
+		batch := totalScores[start:min(start+reconcileBatchSize, len(totalScores))]
+		keys := make([]string, 0, len(batch))
+		for _, ts := range batch {
+			keys = append(keys, courseTotalScoreKey(ts.CourseID, ts.UserID))
+		}
+		cached, err := rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return drifted, err
+		}
+
+		var fixes []courseTotalScore
+		for i, ts := range batch {
+			value, ok := cached[i].(string)
+			if ok && value == strconv.Itoa(ts.TotalScore) {
+				continue
+			}
+			if !ok {
+				value = "(missing)"
+			}
+			fmt.Fprintf(w, "course=%v user=%v cached=%v actual=%v\n", ts.CourseID, ts.UserID, value, ts.TotalScore)
+			fixes = append(fixes, ts)
+		}
+		drifted += len(fixes)
+
+		if dryRun || len(fixes) == 0 {
+			continue
+		}
+		if _, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, ts := range fixes {
+				pipe.Set(ctx, courseTotalScoreKey(ts.CourseID, ts.UserID), ts.TotalScore, 0)
+			}
+			return nil
+		}); err != nil {
+			return drifted, err
+		}
+	}
+
+	fmt.Fprintf(w, "%v of %v course total scores drifted\n", drifted, len(totalScores))
+	return drifted, nil
+}
+
+// runReconcileScores ./isucholar reconcile-scores [-dry-run]
+func runReconcileScores(args []string) int {
+	fs := flag.NewFlagSet("reconcile-scores", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report drift without fixing it")
+	fs.Parse(args)
+
+	db, err := GetDBNoOtel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	if _, err := reconcileCourseTotalScores(context.Background(), db, os.Stdout, *dryRun); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
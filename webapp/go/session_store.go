@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	sessionCachePrefix      = "session"
+	userSessionsCachePrefix = "user_sessions"
+)
+
+// RedisSessionStore セッションの中身をredisに保存し、cookieには署名済みのセッションIDだけを載せるsessions.Store
+type RedisSessionStore struct {
+	client  *redis.Client
+	codecs  []securecookie.Codec
+	options *sessions.Options
+}
+
+// NewRedisSessionStore keysは新しい順に並べる。先頭のキーで署名し、残りは検証のみに使う(キーローテーション用)
+func NewRedisSessionStore(client *redis.Client, keys ...string) *RedisSessionStore {
+	keyPairs := make([][]byte, 0, len(keys)*2)
+	for _, key := range keys {
+		keyPairs = append(keyPairs, []byte(key), nil)
+	}
+	return &RedisSessionStore{
+		client: client,
+		codecs: securecookie.CodecsFromPairs(keyPairs...),
+		options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 3600,
+		},
+	}
+}
+
+// sessionKeysFromEnv SESSION_KEYSはカンマ区切りで新しい順。未設定の場合は起動しない
+func sessionKeysFromEnv() []string {
+	var keys []string
+	for _, key := range strings.Split(GetEnv("SESSION_KEYS", ""), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		panic(errors.New("SESSION_KEYS is not set"))
+	}
+	return keys
+}
+
+func (s *RedisSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *RedisSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	// 署名が合わない(ローテーションで失効した鍵など)cookieは未ログイン扱いにする
+	if err := securecookie.DecodeMulti(name, cookie.Value, &session.ID, s.codecs...); err != nil {
+		return session, nil
+	}
+
+	data, err := s.client.Get(r.Context(), fmt.Sprintf("%v:%v", sessionCachePrefix, session.ID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// 失効済みのセッション
+		session.ID = ""
+		return session, nil
+	} else if err != nil {
+		return session, err
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+
+	return session, nil
+}
+
+func (s *RedisSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	ctx := r.Context()
+
+	if session.Options.MaxAge < 0 {
+		if err := s.delete(ctx, session); err != nil {
+			return err
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if err := s.client.Set(ctx, fmt.Sprintf("%v:%v", sessionCachePrefix, session.ID), data, ttl).Err(); err != nil {
+		return err
+	}
+	if userID, ok := session.Values["userID"].(string); ok {
+		userSessionsKey := fmt.Sprintf("%v:%v", userSessionsCachePrefix, userID)
+		if err := s.client.SAdd(ctx, userSessionsKey, session.ID).Err(); err != nil {
+			return err
+		}
+		if err := s.client.Expire(ctx, userSessionsKey, ttl).Err(); err != nil {
+			return err
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+
+	return nil
+}
+
+// Regenerate セッションを破棄し、次のSaveで新しいIDを発行させる (ログイン時のセッション固定化対策)
+func (s *RedisSessionStore) Regenerate(ctx context.Context, session *sessions.Session) error {
+	if err := s.delete(ctx, session); err != nil {
+		return err
+	}
+	session.ID = ""
+	return nil
+}
+
+func (s *RedisSessionStore) delete(ctx context.Context, session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	if err := s.client.Del(ctx, fmt.Sprintf("%v:%v", sessionCachePrefix, session.ID)).Err(); err != nil {
+		return err
+	}
+	if userID, ok := session.Values["userID"].(string); ok {
+		if err := s.client.SRem(ctx, fmt.Sprintf("%v:%v", userSessionsCachePrefix, userID), session.ID).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeUserSessions 指定したユーザーの全セッションを失効させる
+func (s *RedisSessionStore) RevokeUserSessions(ctx context.Context, userID string) error {
+	userSessionsKey := fmt.Sprintf("%v:%v", userSessionsCachePrefix, userID)
+	sessionIDs, err := s.client.SMembers(ctx, userSessionsKey).Result()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(sessionIDs)+1)
+	for _, sessionID := range sessionIDs {
+		keys = append(keys, fmt.Sprintf("%v:%v", sessionCachePrefix, sessionID))
+	}
+	keys = append(keys, userSessionsKey)
+	return s.client.Del(ctx, keys...).Err()
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 講義の提出ファイルの類似度分析。ファイルの完全一致と、抽出したテキストの文字shingleのJaccard係数で判定する
+
+const (
+	similarityQueueKey = "similarity_jobs:queue"
+	// shingleSize 日本語は単語で区切れないので、空白と記号を除いた文字のn-gramを使う
+	shingleSize = 5
+	// minShingles これより短いテキストは類似度を判定しない(表紙だけのPDFなどが全て一致してしまうため)
+	minShingles = 20
+	// pdfStreamMaxBytes 展開後のPDFのストリームの上限。圧縮爆弾でメモリを使い果たさないよう、超えたストリームは読み飛ばす
+	pdfStreamMaxBytes = 16 << 20
+)
+
+var similarityThreshold, _ = strconv.ParseFloat(GetEnv("SIMILARITY_THRESHOLD", "0.8"), 64)
+
+// enqueueSimilarityAnalysis 講義の提出の締め切り後に類似度分析を行う
+func enqueueSimilarityAnalysis(ctx context.Context, classIDs ...string) error {
+	if len(classIDs) == 0 {
+		return nil
+	}
+	return rdb.LPush(ctx, similarityQueueKey, classIDs).Err()
+}
+
+func (h *handlers) runSimilarityWorker(ctx context.Context, logger echo.Logger) {
+	runQueueWorker(ctx, logger, similarityQueueKey, func(ctx context.Context, classID string) error {
+		return analyzeClassSimilarity(ctx, logger, h.DB, h.Blobs, classID)
+	})
+}
+
+type submissionFingerprint struct {
+	Submission
+	sha256   [sha256.Size]byte
+	shingles map[uint64]struct{}
+}
+
+type similarPair struct {
+	a, b      string
+	identical bool
+	score     float64
+}
+
+// analyzeClassSimilarity 各学生の最新の提出を総当たりで比較し、結果を保存し直す
+func analyzeClassSimilarity(ctx context.Context, logger echo.Logger, db *sqlx.DB, blobs BlobStore, classID string) error {
+	submissions, err := getSubmissionsForExport(ctx, db, classID, false)
+	if err != nil {
+		return err
+	}
+
+	fingerprints := make([]submissionFingerprint, 0, len(submissions))
+	for _, submission := range submissions {
+		fp, err := fingerprintSubmission(ctx, logger, blobs, submission)
+		if errors.Is(err, ErrBlobNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+
+	var pairs []similarPair
+	for i := range fingerprints {
+		for j := i + 1; j < len(fingerprints); j++ {
+			a, b := fingerprints[i], fingerprints[j]
+			identical := a.sha256 == b.sha256
+			score := jaccard(a.shingles, b.shingles)
+			if identical {
+				score = 1
+			}
+			if identical || score >= similarityThreshold {
+				pairs = append(pairs, similarPair{a: a.ID, b: b.ID, identical: identical, score: score})
+			}
+		}
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM `submission_similarities` WHERE `class_id` = ?", classID); err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO `submission_similarities` (`class_id`, `version_id_a`, `version_id_b`, `identical`, `score`) VALUES (?, ?, ?, ?, ?)",
+			classID, p.a, p.b, p.identical, p.score); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO `similarity_analyses` (`class_id`, `analyzed_at`, `submissions`) VALUES (?, now(), ?)"+
+		" ON CONFLICT(class_id) DO UPDATE SET `analyzed_at` = EXCLUDED.analyzed_at, `submissions` = EXCLUDED.submissions",
+		classID, len(fingerprints)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func fingerprintSubmission(ctx context.Context, logger echo.Logger, blobs BlobStore, submission Submission) (submissionFingerprint, error) {
+	fp := submissionFingerprint{Submission: submission}
+	f, err := blobs.Open(ctx, submission.StorageKey)
+	if err != nil {
+		return fp, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fp, err
+	}
+	fp.sha256 = sha256.Sum256(data)
+	text, err := extractText(submission.ContentType, data)
+	if err != nil {
+		// 読めなかった部分を除いたテキストで比較する
+		logger.Warnf("similarity: %v: %v", submission.StorageKey, err)
+	}
+	fp.shingles = textShingles(text)
+	return fp, nil
+}
+
+// extractText 比較用のテキストを取り出す。テキストを持たない形式は完全一致のみで判定する
+func extractText(contentType string, data []byte) (string, error) {
+	switch contentType {
+	case "application/pdf":
+		return extractPDFText(data)
+	case "text/plain":
+		return string(data), nil
+	default:
+		return "", nil
+	}
+}
+
+// textShingles 空白・記号を除いて小文字にしたテキストの文字n-gramのハッシュ
+func textShingles(text string) map[uint64]struct{} {
+	runes := []rune(strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, text))
+
+	shingles := make(map[uint64]struct{})
+	for i := 0; i+shingleSize <= len(runes); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(string(runes[i : i+shingleSize])))
+		shingles[h.Sum64()] = struct{}{}
+	}
+	return shingles
+}
+
+func jaccard(a, b map[uint64]struct{}) float64 {
+	if len(a) < minShingles || len(b) < minShingles {
+		return 0
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	intersection := 0
+	for k := range a {
+		if _, ok := b[k]; ok {
+			intersection++
+		}
+	}
+	return float64(intersection) / float64(len(a)+len(b)-intersection)
+}
+
+// extractPDFText PDFのコンテンツストリームから文字列を取り出す。
+// フォントのエンコーディングは解釈しないので人が読める文字列になるとは限らないが、同じ内容のPDF同士の比較には十分。
+// 読めなかったストリームがあってもそれ以外から取り出した文字列を返し、エラーも合わせて返す
+func extractPDFText(data []byte) (string, error) {
+	var sb strings.Builder
+	var errs []error
+	for rest := data; ; {
+		i := bytes.Index(rest, []byte("stream"))
+		if i < 0 {
+			break
+		}
+		// "endstream" にもマッチするので読み飛ばす
+		if i >= 3 && string(rest[i-3:i]) == "end" {
+			rest = rest[i+len("stream"):]
+			continue
+		}
+		dict := rest[max(0, i-1024):i]
+		if d := bytes.LastIndex(dict, []byte("obj")); d >= 0 {
+			dict = dict[d:]
+		}
+		body := bytes.TrimLeft(rest[i+len("stream"):], "\r\n")
+		end := bytes.Index(body, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		content := body[:end]
+		rest = body[end+len("endstream"):]
+
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			r, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			inflated, err := io.ReadAll(io.LimitReader(r, pdfStreamMaxBytes+1))
+			r.Close()
+			if len(inflated) > pdfStreamMaxBytes {
+				errs = append(errs, errPDFStreamTooLarge)
+				continue
+			}
+			if err != nil {
+				// 壊れたストリームでも読めたところまでは使う
+				errs = append(errs, err)
+			}
+			content = inflated
+		}
+		writePDFTextOperands(&sb, content)
+	}
+	return sb.String(), errors.Join(errs...)
+}
+
+var errPDFStreamTooLarge = errors.New("pdf stream exceeds the size limit")
+
+// writePDFTextOperands BT〜ETの中の文字列リテラル (...) と16進文字列 <...> を書き出す
+func writePDFTextOperands(sb *strings.Builder, content []byte) {
+	inText := false
+	for i := 0; i < len(content); i++ {
+		switch b := content[i]; {
+		case !inText:
+			if b == 'B' && i+1 < len(content) && content[i+1] == 'T' {
+				inText = true
+				i++
+			}
+		case b == 'E' && i+1 < len(content) && content[i+1] == 'T':
+			inText = false
+			sb.WriteByte(' ')
+			i++
+		case b == '(':
+			i = readPDFLiteralString(sb, content, i+1)
+			sb.WriteByte(' ')
+		case b == '<' && i+1 < len(content) && content[i+1] != '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return
+			}
+			writePDFHexString(sb, content[i+1:i+end])
+			sb.WriteByte(' ')
+			i += end
+		}
+	}
+}
+
+// readPDFLiteralString 括弧の対応とエスケープを考慮して文字列を読み、閉じ括弧の位置を返す
+func readPDFLiteralString(sb *strings.Builder, content []byte, i int) int {
+	depth := 1
+	for ; i < len(content); i++ {
+		switch b := content[i]; b {
+		case '\\':
+			i++
+			if i < len(content) {
+				switch c := content[i]; c {
+				case 'n', 'r', 't':
+					sb.WriteByte(' ')
+				case '\r', '\n':
+				default:
+					if '0' <= c && c <= '7' {
+						// 8進エスケープ
+						n := 0
+						for k := 0; k < 3 && i < len(content) && '0' <= content[i] && content[i] <= '7'; k++ {
+							n = n*8 + int(content[i]-'0')
+							i++
+						}
+						i--
+						sb.WriteByte(byte(n))
+					} else {
+						sb.WriteByte(c)
+					}
+				}
+			}
+		case '(':
+			depth++
+			sb.WriteByte(b)
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+			sb.WriteByte(b)
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	return i
+}
+
+func writePDFHexString(sb *strings.Builder, hex []byte) {
+	var digits []byte
+	for _, c := range hex {
+		if unicode.Is(unicode.ASCII_Hex_Digit, rune(c)) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	for i := 0; i < len(digits); i += 2 {
+		n, _ := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		sb.WriteByte(byte(n))
+	}
+}
+
+type SimilarSubmissionPair struct {
+	UserCodeA  string  `json:"user_code_a" db:"user_code_a"`
+	VersionIDA string  `json:"version_id_a" db:"version_id_a"`
+	UserCodeB  string  `json:"user_code_b" db:"user_code_b"`
+	VersionIDB string  `json:"version_id_b" db:"version_id_b"`
+	Identical  bool    `json:"identical" db:"identical"`
+	Score      float64 `json:"score" db:"score"`
+}
+
+type GetSimilarityResponse struct {
+	AnalyzedAt  time.Time               `json:"analyzed_at" db:"analyzed_at"`
+	Submissions int                     `json:"submissions" db:"submissions"`
+	Pairs       []SimilarSubmissionPair `json:"pairs" db:"-"`
+}
+
+// GetSubmissionSimilarity GET /api/courses/:courseID/classes/:classID/assignments/similarity 類似した提出の組の一覧
+// min_score を指定した場合はそれ以上の組のみ返す
+func (h *handlers) GetSubmissionSimilarity(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+	minScore := 0.0
+	if s := c.QueryParam("min_score"); s != "" {
+		var err error
+		if minScore, err = strconv.ParseFloat(s, 64); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid min_score.")
+		}
+	}
+	ctx := c.Request().Context()
+
+	var res GetSimilarityResponse
+	query := "SELECT `similarity_analyses`.`analyzed_at`, `similarity_analyses`.`submissions`" +
+		" FROM `similarity_analyses`" +
+		" JOIN `classes` ON `classes`.`id` = `similarity_analyses`.`class_id`" +
+		" WHERE `classes`.`id` = ? AND `classes`.`course_id` = ?"
+	if err := h.DB.GetContext(ctx, &res, query, classID, courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "The submissions of this class have not been analyzed yet.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res.Pairs = make([]SimilarSubmissionPair, 0)
+	query = "SELECT `users_a`.`code` AS `user_code_a`, `submission_similarities`.`version_id_a`," +
+		" `users_b`.`code` AS `user_code_b`, `submission_similarities`.`version_id_b`," +
+		" `submission_similarities`.`identical`, `submission_similarities`.`score`" +
+		" FROM `submission_similarities`" +
+		" JOIN `submission_versions` `versions_a` ON `versions_a`.`id` = `submission_similarities`.`version_id_a`" +
+		" JOIN `users` `users_a` ON `users_a`.`id` = `versions_a`.`user_id`" +
+		" JOIN `submission_versions` `versions_b` ON `versions_b`.`id` = `submission_similarities`.`version_id_b`" +
+		" JOIN `users` `users_b` ON `users_b`.`id` = `versions_b`.`user_id`" +
+		" WHERE `submission_similarities`.`class_id` = ? AND `submission_similarities`.`score` >= ?" +
+		" ORDER BY `submission_similarities`.`score` DESC, `users_a`.`code`, `users_b`.`code`"
+	if err := h.DB.SelectContext(ctx, &res.Pairs, query, classID, minScore); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// AnalyzeSubmissionSimilarity POST /api/courses/:courseID/classes/:classID/assignments/similarity 類似度分析のやり直し
+// 提出の締め切り時には自動で分析される
+func (h *handlers) AnalyzeSubmissionSimilarity(c echo.Context) error {
+	courseID := c.Param("courseID")
+	classID := c.Param("classID")
+
+	var classCount int
+	if err := h.DB.GetContext(c.Request().Context(), &classCount, "SELECT 1 FROM `classes` WHERE `id` = ? AND `course_id` = ?", classID, courseID); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such class.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := enqueueSimilarityAnalysis(c.Request().Context(), classID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
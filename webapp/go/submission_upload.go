@@ -0,0 +1,79 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var submissionMaxBytes = int64(GetEnvPositiveInt("SUBMISSION_MAX_BYTES", 10<<20))
+
+// submissionFormOverhead multipartの境界やファイル以外のフィールドの分
+const submissionFormOverhead = 64 << 10
+
+const (
+	defaultAllowedTypes = "application/pdf"
+	maxFileNameBytes    = 255
+)
+
+// submissionTypes 提出を受け付けられるファイル形式と保存時の拡張子。http.DetectContentTypeで判定できるもののみ
+var submissionTypes = map[string]string{
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"text/plain":      ".txt",
+}
+
+// allowedTypes 講義で提出を受け付けるファイル形式
+func (c Class) allowedTypes() []string {
+	return strings.Split(c.AllowedTypes, ",")
+}
+
+// validateAllowedTypes エラーの場合はレスポンスのメッセージを返す
+func validateAllowedTypes(types []string) string {
+	if len(types) == 0 {
+		return "Invalid allowed types."
+	}
+	for _, t := range types {
+		if _, ok := submissionTypes[t]; !ok {
+			return "Unsupported file type: " + t
+		}
+	}
+	return ""
+}
+
+// detectContentType ファイルの内容からパラメータを除いたMIMEタイプを判定する。クライアントが送るContent-Typeは信用しない
+func detectContentType(data []byte) string {
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// sanitizeFileName アップロードされたファイル名からディレクトリや制御文字を取り除く。
+// zipのエントリ名にもなるので、../ などでの展開先の外への書き込みを防ぐ
+func sanitizeFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' || r == ':' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if len(name) > maxFileNameBytes {
+		name = name[:maxFileNameBytes]
+		for !utf8.ValidString(name) {
+			name = name[:len(name)-1]
+		}
+	}
+	if name == "" {
+		return "submission"
+	}
+	return name
+}
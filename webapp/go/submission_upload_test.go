@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"japanese", "レポート 第1回.pdf", "レポート 第1回.pdf"},
+		{"unix path", "/home/user/report.pdf", "report.pdf"},
+		{"windows path", `C:\Users\user\report.pdf`, "report.pdf"},
+		{"parent directory", "../../etc/passwd", "passwd"},
+		{"control characters", "rep\x00ort\n.pdf", "report.pdf"},
+		{"colon", "a:b.pdf", "ab.pdf"},
+		{"leading dots", "..hidden.pdf", "hidden.pdf"},
+		{"surrounding spaces", "  report.pdf  ", "report.pdf"},
+		{"empty", "", "submission"},
+		{"only dots", "..", "submission"},
+		{"only separators", "///", "submission"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeFileName(tt.in); got != tt.want {
+				t.Errorf("sanitizeFileName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFileNameTruncates(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"ascii", strings.Repeat("a", maxFileNameBytes+10)},
+		{"multibyte", strings.Repeat("あ", maxFileNameBytes)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeFileName(tt.in)
+			if len(got) > maxFileNameBytes {
+				t.Errorf("sanitizeFileName returned %d bytes, want at most %d", len(got), maxFileNameBytes)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("sanitizeFileName returned invalid UTF-8: %q", got)
+			}
+			if !strings.HasPrefix(tt.in, got) {
+				t.Errorf("sanitizeFileName(%q) = %q, want a prefix of the input", tt.in, got)
+			}
+		})
+	}
+}
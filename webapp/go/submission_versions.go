@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// addSubmissionVersion 提出ファイルを新しいバージョンとして保存し、そのバージョン番号と保存先のキーを返す。
+// 同じ学生の同時提出でバージョン番号が重複しないよう、submissionsの行をロックした後に呼ぶこと。
+// ファイルはトランザクションの外に保存されるので、呼び出し側はcommitに失敗した場合にキーのファイルを消すこと
+func addSubmissionVersion(ctx context.Context, tx *sqlx.Tx, blobs BlobStore, userID, classID, fileName, contentType string, data []byte, late bool) (int, string, error) {
+	var version int
+	if err := tx.GetContext(ctx, &version, "SELECT COALESCE(MAX(`version`), 0) + 1 FROM `submission_versions` WHERE `class_id` = ? AND `user_id` = ?", classID, userID); err != nil {
+		return 0, "", err
+	}
+
+	versionID := newULID()
+	storageKey := classID + "-" + userID + "-" + versionID + submissionTypes[contentType]
+	if err := blobs.Put(ctx, storageKey, bytes.NewReader(data), int64(len(data))); err != nil {
+		return 0, "", err
+	}
+
+	digest := sha256.Sum256(data)
+	if _, err := tx.ExecContext(ctx, "INSERT INTO `submission_versions` (`id`, `user_id`, `class_id`, `version`, `file_name`, `content_type`, `size`, `sha256`, `storage_key`, `late`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		versionID, userID, classID, version, fileName, contentType, len(data), hex.EncodeToString(digest[:]), storageKey, late); err != nil {
+		// どのバージョンからも参照されないファイルを残さない
+		return 0, "", errors.Join(err, blobs.Delete(context.WithoutCancel(ctx), storageKey))
+	}
+	return version, storageKey, nil
+}
+
+type SubmissionVersion struct {
+	ID          string    `json:"id" db:"id"`
+	UserCode    string    `json:"user_code" db:"user_code"`
+	Version     int       `json:"version" db:"version"`
+	FileName    string    `json:"file_name" db:"file_name"`
+	ContentType string    `json:"content_type" db:"content_type"`
+	Size        *int64    `json:"size" db:"size"`
+	SHA256      *string   `json:"sha256" db:"sha256"`
+	Late        bool      `json:"late" db:"late"`
+	SubmittedAt time.Time `json:"submitted_at" db:"created_at"`
+	UserID      string    `json:"-" db:"user_id"`
+	StorageKey  string    `json:"-" db:"storage_key"`
+}
+
+const selectSubmissionVersionsQuery = "SELECT `submission_versions`.`id`, `users`.`code` AS `user_code`, `submission_versions`.`version`, `submission_versions`.`file_name`, `submission_versions`.`content_type`," +
+	" `submission_versions`.`size`, `submission_versions`.`sha256`, `submission_versions`.`late`, `submission_versions`.`created_at`," +
+	" `submission_versions`.`user_id`, `submission_versions`.`storage_key`" +
+	" FROM `submission_versions`" +
+	" JOIN `users` ON `users`.`id` = `submission_versions`.`user_id`" +
+	" JOIN `classes` ON `classes`.`id` = `submission_versions`.`class_id`"
+
+// GetMySubmissionVersions GET /api/courses/:courseID/classes/:classID/assignments/mine 自分の提出履歴
+func (h *handlers) GetMySubmissionVersions(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	versions := make([]SubmissionVersion, 0)
+	query := selectSubmissionVersionsQuery +
+		" WHERE `classes`.`course_id` = ? AND `submission_versions`.`class_id` = ? AND `submission_versions`.`user_id` = ?" +
+		" ORDER BY `submission_versions`.`version` DESC"
+	if err := h.DB.SelectContext(c.Request().Context(), &versions, query, c.Param("courseID"), c.Param("classID"), userID); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, versions)
+}
+
+// GetSubmissionVersions GET /api/courses/:courseID/classes/:classID/assignments/versions 全学生の提出履歴
+// user_code を指定した場合はその学生の履歴のみ返す
+func (h *handlers) GetSubmissionVersions(c echo.Context) error {
+	query := selectSubmissionVersionsQuery +
+		" WHERE `classes`.`course_id` = ? AND `submission_versions`.`class_id` = ?"
+	args := []interface{}{c.Param("courseID"), c.Param("classID")}
+	if userCode := c.QueryParam("user_code"); userCode != "" {
+		query += " AND `users`.`code` = ?"
+		args = append(args, userCode)
+	}
+	query += " ORDER BY `users`.`code`, `submission_versions`.`version` DESC"
+
+	versions := make([]SubmissionVersion, 0)
+	if err := h.DB.SelectContext(c.Request().Context(), &versions, query, args...); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, versions)
+}
+
+// DownloadSubmissionVersion GET /api/courses/:courseID/classes/:classID/assignments/versions/:versionID 提出ファイルのダウンロード
+// 提出した学生本人か、提出物をダウンロードする権限を持つユーザのみ取得できる
+func (h *handlers) DownloadSubmissionVersion(c echo.Context) error {
+	userID, _, _, err := getUserInfo(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	courseID := c.Param("courseID")
+
+	var version SubmissionVersion
+	query := selectSubmissionVersionsQuery +
+		" WHERE `classes`.`course_id` = ? AND `submission_versions`.`class_id` = ? AND `submission_versions`.`id` = ?"
+	if err := h.DB.GetContext(c.Request().Context(), &version, query, courseID, c.Param("classID"), c.Param("versionID")); errors.Is(err, sql.ErrNoRows) {
+		return c.String(http.StatusNotFound, "No such submission.")
+	} else if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if version.UserID != userID {
+		if ok, err := h.hasPermission(c, PermExportAssignments, courseID); err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		} else if !ok {
+			// 他の学生の提出の存在を明かさない
+			return c.String(http.StatusNotFound, "No such submission.")
+		}
+	}
+
+	f, err := h.Blobs.Open(c.Request().Context(), version.StorageKey)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer f.Close()
+
+	fileName := version.UserCode + "-" + sanitizeFileName(version.FileName)
+	c.Response().Header().Set(echo.HeaderContentType, version.ContentType)
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", fileName))
+	http.ServeContent(c.Response(), c.Request(), fileName, version.SubmittedAt, f)
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+const termDateLayout = "2006-01-02"
+
+type Term struct {
+	ID       string `json:"id" db:"id"`
+	Name     string `json:"name" db:"name"`
+	StartsOn string `json:"starts_on" db:"starts_on"`
+	EndsOn   string `json:"ends_on" db:"ends_on"`
+}
+
+const selectTermsQuery = "SELECT `id`, `name`, to_char(`starts_on`, 'YYYY-MM-DD') AS `starts_on`, to_char(`ends_on`, 'YYYY-MM-DD') AS `ends_on` FROM `terms`"
+
+// termKey 学期未設定の科目同士は同じ学期として扱う
+func termKey(termID *string) string {
+	return lo.FromPtr(termID)
+}
+
+func termExists(ctx context.Context, db sqlx.QueryerContext, termID string) (bool, error) {
+	var count int
+	if err := sqlx.GetContext(ctx, db, &count, "SELECT 1 FROM `terms` WHERE `id` = ?", termID); errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetTerms GET /api/terms 学期一覧
+func (h *handlers) GetTerms(c echo.Context) error {
+	terms := make([]Term, 0)
+	if err := h.DB.SelectContext(c.Request().Context(), &terms, selectTermsQuery+" ORDER BY `starts_on`, `id`"); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, terms)
+}
+
+type AddTermRequest struct {
+	Name     string `json:"name"`
+	StartsOn string `json:"starts_on"`
+	EndsOn   string `json:"ends_on"`
+}
+
+type AddTermResponse struct {
+	ID string `json:"id"`
+}
+
+// AddTerm POST /api/terms 学期の追加
+func (h *handlers) AddTerm(c echo.Context) error {
+	var req AddTermRequest
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid format.")
+	}
+	if req.Name == "" {
+		return c.String(http.StatusBadRequest, "Invalid name.")
+	}
+	startsOn, err := time.Parse(termDateLayout, req.StartsOn)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Invalid starts_on.")
+	}
+	endsOn, err := time.Parse(termDateLayout, req.EndsOn)
+	if err != nil || endsOn.Before(startsOn) {
+		return c.String(http.StatusBadRequest, "Invalid ends_on.")
+	}
+
+	termID := newULID()
+	if _, err := h.DB.ExecContext(c.Request().Context(), "INSERT INTO `terms` (`id`, `name`, `starts_on`, `ends_on`) VALUES (?, ?, ?, ?)",
+		termID, req.Name, startsOn, endsOn); err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, AddTermResponse{ID: termID})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type Ticker struct {
+	d    time.Duration
+	t    *time.Ticker
+	f    func()
+	s    chan struct{}
+	once sync.Once
+}
+
+// NewTicker time.Tickerはここで作るので、Start前やStartと並行してStop/Resetを呼んでも良い
+func NewTicker(durationMS int, callback func()) *Ticker {
+	d := time.Duration(durationMS) * time.Millisecond
+	return &Ticker{
+		d: d,
+		t: time.NewTicker(d),
+		f: callback,
+		s: make(chan struct{}),
+	}
+}
+
+// go t.Start()
+func (t *Ticker) Start() {
+	for {
+		select {
+		case <-t.t.C:
+			go t.f()
+		case <-t.s:
+			return
+		}
+	}
+}
+
+func (t *Ticker) Stop() {
+	t.once.Do(func() {
+		t.t.Stop()
+		close(t.s)
+	})
+}
+
+func (t *Ticker) Reset() {
+	t.t.Reset(t.d)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/samber/lo"
+)
+
+// timetablePeriods 時間割に常に表示する時限数。これより後の時限の科目がある場合はその時限まで表示する
+const timetablePeriods = maxPeriod
+
+// periodStartTimes 各時限の開始時刻(時, 分)。1コマ90分
+var periodStartTimes = [][2]int{{9, 0}, {10, 40}, {13, 0}, {14, 40}, {16, 20}, {18, 0}}
+
+const periodDuration = 90 * time.Minute
+
+var icalWeekdays = map[DayOfWeek]string{
+	Monday:    "MO",
+	Tuesday:   "TU",
+	Wednesday: "WE",
+	Thursday:  "TH",
+	Friday:    "FR",
+}
+
+var goWeekdays = map[DayOfWeek]time.Weekday{
+	Monday:    time.Monday,
+	Tuesday:   time.Tuesday,
+	Wednesday: time.Wednesday,
+	Thursday:  time.Thursday,
+	Friday:    time.Friday,
+}
+
+type TimetableCourse struct {
+	ID      string  `json:"id"`
+	Code    string  `json:"code"`
+	Name    string  `json:"name"`
+	Teacher string  `json:"teacher"`
+	TermID  *string `json:"term_id"`
+}
+
+type TimetableSlot struct {
+	DayOfWeek DayOfWeek         `json:"day_of_week"`
+	Period    uint8             `json:"period"`
+	Courses   []TimetableCourse `json:"courses"`
+}
+
+type GetTimetableResponse struct {
+	Days    []DayOfWeek       `json:"days"`
+	Periods int               `json:"periods"`
+	Grid    [][]TimetableSlot `json:"grid"` // grid[曜日][時限-1]
+}
+
+type timetableCourse struct {
+	Course
+	TeacherName string `db:"teacher_name"`
+}
+
+// getTimetableCourses 学生は履修中の科目、教員は担当(共同担当を含む)している科目を返す
+func (h *handlers) getTimetableCourses(c echo.Context) ([]timetableCourse, error) {
+	userID, _, isAdmin, err := getUserInfo(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var query string
+	var args []interface{}
+	if isAdmin {
+		query = "SELECT `courses`.*, `users`.`name` AS `teacher_name`" +
+			" FROM `courses`" +
+			" JOIN `users` ON `users`.`id` = `courses`.`teacher_id`" +
+			" WHERE `courses`.`status` != ? AND (`courses`.`teacher_id` = ? OR `courses`.`id` IN (SELECT `course_id` FROM `course_teachers` WHERE `user_id` = ?))"
+		args = []interface{}{StatusClosed, userID, userID}
+	} else {
+		query = "SELECT `courses`.*, `users`.`name` AS `teacher_name`" +
+			" FROM `courses`" +
+			" JOIN `users` ON `users`.`id` = `courses`.`teacher_id`" +
+			" JOIN `registrations` ON `registrations`.`course_id` = `courses`.`id`" +
+			" WHERE `courses`.`status` != ? AND `registrations`.`user_id` = ?"
+		args = []interface{}{StatusClosed, userID}
+	}
+	if termID := c.QueryParam("term"); termID != "" {
+		query += " AND `courses`.`term_id` = ?"
+		args = append(args, termID)
+	}
+	query += " ORDER BY `courses`.`period`, `courses`.`code`"
+
+	courses := make([]timetableCourse, 0)
+	if err := h.DB.SelectContext(c.Request().Context(), &courses, query, args...); err != nil {
+		return nil, err
+	}
+	return courses, nil
+}
+
+// GetTimetable GET /api/users/me/timetable 週間時間割(曜日×時限)の取得
+func (h *handlers) GetTimetable(c echo.Context) error {
+	courses, err := h.getTimetableCourses(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	periods := timetablePeriods
+	for _, course := range courses {
+		periods = lo.Max([]int{periods, int(course.Period)})
+	}
+
+	grid := make([][]TimetableSlot, len(daysOfWeek))
+	for i, day := range daysOfWeek {
+		grid[i] = make([]TimetableSlot, periods)
+		for j := range grid[i] {
+			grid[i][j] = TimetableSlot{
+				DayOfWeek: day,
+				Period:    uint8(j + 1),
+				Courses:   []TimetableCourse{},
+			}
+		}
+	}
+	for _, course := range courses {
+		i := lo.IndexOf(daysOfWeek, course.DayOfWeek)
+		if i < 0 || course.Period < 1 {
+			continue
+		}
+		slot := &grid[i][course.Period-1]
+		slot.Courses = append(slot.Courses, TimetableCourse{
+			ID:      course.ID,
+			Code:    course.Code,
+			Name:    course.Name,
+			Teacher: course.TeacherName,
+			TermID:  course.TermID,
+		})
+	}
+
+	return c.JSON(http.StatusOK, GetTimetableResponse{
+		Days:    daysOfWeek,
+		Periods: periods,
+		Grid:    grid,
+	})
+}
+
+// GetTimetableICalendar GET /api/users/me/timetable.ics 週間時間割のiCalendar形式での取得
+func (h *handlers) GetTimetableICalendar(c echo.Context) error {
+	courses, err := h.getTimetableCourses(c)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	terms, err := h.getTermsByID(c.Request().Context(), lo.Uniq(lo.FilterMap(courses, func(course timetableCourse, _ int) (string, bool) {
+		return lo.FromPtr(course.TermID), course.TermID != nil
+	})))
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	now := time.Now()
+	cal := newICalendar()
+	for _, course := range courses {
+		weekday, ok := icalWeekdays[course.DayOfWeek]
+		if !ok || course.Period < 1 {
+			continue
+		}
+
+		// 学期が未設定の科目は今週から期限なしで繰り返す
+		from := now
+		var until *time.Time
+		if term, ok := terms[lo.FromPtr(course.TermID)]; ok {
+			startsOn, err := time.ParseInLocation(termDateLayout, term.StartsOn, jst)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			endsOn, err := time.ParseInLocation(termDateLayout, term.EndsOn, jst)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			from = startsOn
+			until = lo.ToPtr(endsOn.Add(24*time.Hour - time.Second))
+		}
+		start := firstClassStart(from, goWeekdays[course.DayOfWeek], course.Period)
+
+		rrule := "FREQ=WEEKLY;BYDAY=" + weekday
+		if until != nil {
+			if start.After(*until) {
+				continue
+			}
+			rrule += ";UNTIL=" + until.UTC().Format(icalUTCLayout)
+		}
+
+		cal.event(
+			"UID:"+course.ID+"@isucholar",
+			"DTSTAMP:"+now.UTC().Format(icalUTCLayout),
+			"DTSTART;TZID=Asia/Tokyo:"+start.Format(icalLocalLayout),
+			"DTEND;TZID=Asia/Tokyo:"+start.Add(periodDuration).Format(icalLocalLayout),
+			"RRULE:"+rrule,
+			"SUMMARY:"+icalEscape(course.Name),
+			"DESCRIPTION:"+icalEscape(fmt.Sprintf("%v %v", course.Code, course.TeacherName)),
+		)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="timetable.ics"`)
+	return c.Blob(http.StatusOK, "text/calendar; charset=utf-8", []byte(cal.String()))
+}
+
+func (h *handlers) getTermsByID(ctx context.Context, termIDs []string) (map[string]Term, error) {
+	if len(termIDs) == 0 {
+		return map[string]Term{}, nil
+	}
+	query, args, err := sqlx.In(selectTermsQuery+" WHERE `id` IN (?)", termIDs)
+	if err != nil {
+		return nil, err
+	}
+	var terms []Term
+	if err := h.DB.SelectContext(ctx, &terms, query, args...); err != nil {
+		return nil, err
+	}
+	return lo.KeyBy(terms, func(term Term) string {
+		return term.ID
+	}), nil
+}
+
+var jst = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+// periodStart 時限の開始時刻。periodStartTimesより後の時限は1コマ100分間隔とする
+func periodStart(day time.Time, period uint8) time.Time {
+	i := int(period) - 1
+	last := len(periodStartTimes) - 1
+	hm := periodStartTimes[lo.Min([]int{i, last})]
+	t := time.Date(day.Year(), day.Month(), day.Day(), hm[0], hm[1], 0, 0, jst)
+	if i > last {
+		t = t.Add(time.Duration(i-last) * 100 * time.Minute)
+	}
+	return t
+}
+
+// firstClassStart from以降で最初の授業の開始時刻
+func firstClassStart(from time.Time, weekday time.Weekday, period uint8) time.Time {
+	from = from.In(jst)
+	day := from.AddDate(0, 0, (int(weekday)-int(from.Weekday())+7)%7)
+	return periodStart(day, period)
+}
+
+const (
+	icalUTCLayout   = "20060102T150405Z"
+	icalLocalLayout = "20060102T150405"
+)
+
+type iCalendar struct {
+	lines []string
+}
+
+func newICalendar() *iCalendar {
+	return &iCalendar{lines: []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//isucholar//timetable//JA",
+		"CALSCALE:GREGORIAN",
+		"X-WR-CALNAME:時間割",
+		"BEGIN:VTIMEZONE",
+		"TZID:Asia/Tokyo",
+		"BEGIN:STANDARD",
+		"DTSTART:19700101T000000",
+		"TZOFFSETFROM:+0900",
+		"TZOFFSETTO:+0900",
+		"TZNAME:JST",
+		"END:STANDARD",
+		"END:VTIMEZONE",
+	}}
+}
+
+func (cal *iCalendar) event(props ...string) {
+	cal.lines = append(cal.lines, "BEGIN:VEVENT")
+	cal.lines = append(cal.lines, props...)
+	cal.lines = append(cal.lines, "END:VEVENT")
+}
+
+func (cal *iCalendar) String() string {
+	var sb strings.Builder
+	for _, line := range append(cal.lines, "END:VCALENDAR") {
+		sb.WriteString(icalFold(line))
+		sb.WriteString("\r\n")
+	}
+	return sb.String()
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func icalEscape(s string) string {
+	return icalEscaper.Replace(s)
+}
+
+// icalFold RFC 5545に従い75オクテットを超える行を折り返す。マルチバイト文字の途中では折り返さない
+func icalFold(line string) string {
+	var sb strings.Builder
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > 75 {
+			sb.WriteString("\r\n ")
+			n = 1
+		}
+		sb.WriteRune(r)
+		n += size
+	}
+	return sb.String()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestICalEscape(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"plain", "plain"},
+		{`a\b`, `a\\b`},
+		{"a;b,c", `a\;b\,c`},
+		{"line1\nline2", `line1\nline2`},
+		{"line1\r\nline2", `line1\nline2`},
+		{`\;`, `\\\;`},
+	}
+	for _, tt := range tests {
+		if got := icalEscape(tt.in); got != tt.want {
+			t.Errorf("icalEscape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestICalFold(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"short", "SUMMARY:test", "SUMMARY:test"},
+		{"exactly 75 octets", strings.Repeat("a", 75), strings.Repeat("a", 75)},
+		{"76 octets", strings.Repeat("a", 76), strings.Repeat("a", 75) + "\r\n a"},
+		{"continuation lines include the leading space", strings.Repeat("a", 150), strings.Repeat("a", 75) + "\r\n " + strings.Repeat("a", 74) + "\r\n a"},
+		{"multibyte character is not split", strings.Repeat("a", 74) + "あ", strings.Repeat("a", 74) + "\r\n あ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := icalFold(tt.in)
+			if got != tt.want {
+				t.Errorf("icalFold(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			for _, line := range strings.Split(got, "\r\n") {
+				if len(line) > 75 {
+					t.Errorf("folded line is %d octets: %q", len(line), line)
+				}
+			}
+		})
+	}
+}
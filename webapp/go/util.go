@@ -4,6 +4,8 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,6 +20,15 @@ func GetEnv(key, val string) string {
 	}
 }
 
+// GetEnvPositiveInt 環境変数を正の整数として読む。未設定・不正な値・0以下の場合はvalを使う
+func GetEnvPositiveInt(key string, val int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n <= 0 {
+		return val
+	}
+	return n
+}
+
 func contains(arr []DayOfWeek, day DayOfWeek) bool {
 	for _, v := range arr {
 		if v == day {
@@ -88,6 +99,37 @@ func stdDevInt(arr []int, avg float64) float64 {
 	return math.Sqrt(sdmSum / float64(len(arr)))
 }
 
+// percentileInt p(0~100)パーセンタイル。順位の間は線形補間する
+func percentileInt(arr []int, p float64, or float64) float64 {
+	if len(arr) == 0 {
+		return or
+	}
+	sorted := slices.Clone(arr)
+	slices.Sort(sorted)
+	rank := p / 100 * float64(len(sorted)-1)
+	lower, upper := int(math.Floor(rank)), int(math.Ceil(rank))
+	return float64(sorted[lower]) + float64(sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+func medianInt(arr []int, or float64) float64 {
+	return percentileInt(arr, 50, or)
+}
+
+// histogramInt 幅widthの区間毎の個数。n個目の区間はそれ以上の値を全て含む
+func histogramInt(arr []int, width int, n int) []int {
+	counts := make([]int, n)
+	for _, v := range arr {
+		i := v / width
+		if i >= n {
+			i = n - 1
+		} else if i < 0 {
+			i = 0
+		}
+		counts[i]++
+	}
+	return counts
+}
+
 func tScoreInt(v int, arr []int) float64 {
 	avg := averageInt(arr, 0)
 	stdDev := stdDevInt(arr, avg)
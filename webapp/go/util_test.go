@@ -0,0 +1,61 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPercentileInt(t *testing.T) {
+	tests := []struct {
+		name string
+		arr  []int
+		p    float64
+		want float64
+	}{
+		{"empty", nil, 50, -1},
+		{"single value", []int{7}, 90, 7},
+		{"minimum", []int{30, 10, 20}, 0, 10},
+		{"maximum", []int{30, 10, 20}, 100, 30},
+		{"odd median", []int{30, 10, 20}, 50, 20},
+		{"even median is interpolated", []int{40, 10, 30, 20}, 50, 25},
+		{"quartile is interpolated", []int{0, 10, 20, 30, 40}, 25, 10},
+		{"between ranks", []int{0, 100}, 30, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentileInt(tt.arr, tt.p, -1); got != tt.want {
+				t.Errorf("percentileInt(%v, %v) = %v, want %v", tt.arr, tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPercentileIntDoesNotSortInput(t *testing.T) {
+	arr := []int{3, 1, 2}
+	percentileInt(arr, 50, 0)
+	if !slices.Equal(arr, []int{3, 1, 2}) {
+		t.Errorf("input was modified: %v", arr)
+	}
+}
+
+func TestHistogramInt(t *testing.T) {
+	tests := []struct {
+		name  string
+		arr   []int
+		width int
+		n     int
+		want  []int
+	}{
+		{"empty", nil, 10, 3, []int{0, 0, 0}},
+		{"bucket boundaries", []int{0, 9, 10, 19, 20}, 10, 3, []int{2, 2, 1}},
+		{"last bucket takes larger values", []int{25, 100, 1000}, 10, 3, []int{0, 0, 3}},
+		{"negative values go to the first bucket", []int{-5, 5}, 10, 2, []int{2, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := histogramInt(tt.arr, tt.width, tt.n); !slices.Equal(got, tt.want) {
+				t.Errorf("histogramInt(%v, %d, %d) = %v, want %v", tt.arr, tt.width, tt.n, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// checkCapacity 定員に達している科目のIDを返す。同時実行時に定員を超えないよう、定員のある科目の行をロックする
+func checkCapacity(ctx context.Context, tx *sqlx.Tx, courseIDs []string) ([]string, error) {
+	if len(courseIDs) == 0 {
+		return nil, nil
+	}
+
+	type courseCapacity struct {
+		ID       string `db:"id"`
+		Capacity int    `db:"capacity"`
+	}
+	// デッドロックを避けるためid順にロックする
+	query, args, err := sqlx.In("SELECT `id`, `capacity` FROM `courses` WHERE `id` IN (?) AND `capacity` IS NOT NULL ORDER BY `id` FOR UPDATE", courseIDs)
+	if err != nil {
+		return nil, err
+	}
+	var locked []courseCapacity
+	if err := tx.SelectContext(ctx, &locked, query, args...); err != nil {
+		return nil, err
+	}
+
+	var full []string
+	for _, course := range locked {
+		var registered, waiting int
+		if err := tx.GetContext(ctx, &registered, "SELECT COUNT(*) FROM `registrations` WHERE `course_id` = ?", course.ID); err != nil {
+			return nil, err
+		}
+		// キャンセル待ちがいる場合は割り込ませない
+		if err := tx.GetContext(ctx, &waiting, "SELECT COUNT(*) FROM `waitlists` WHERE `course_id` = ?", course.ID); err != nil {
+			return nil, err
+		}
+		if registered >= course.Capacity || waiting > 0 {
+			full = append(full, course.ID)
+		}
+	}
+
+	return full, nil
+}
+
+// enqueueWaitlist キャンセル待ちに追加する。既に並んでいる場合は順番を維持する
+func enqueueWaitlist(ctx context.Context, db sqlx.ExtContext, userID string, courseIDs []string) error {
+	for _, courseID := range courseIDs {
+		if _, err := db.ExecContext(ctx, "INSERT INTO `waitlists` (`id`, `course_id`, `user_id`) VALUES (?, ?, ?) ON CONFLICT(course_id, user_id) DO NOTHING",
+			newULID(), courseID, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promoteFromWaitlist 空席ができた科目について、キャンセル待ちの先頭から履修登録しお知らせを送る。
+// 時間割の重複・前提科目・単位数の上限を満たさない学生は飛ばす(待ち行列には残る)。繰り上がった学生のIDを返すので、呼び出し側はcommit後に成績のキャッシュを初期化すること
+func promoteFromWaitlist(ctx context.Context, tx *sqlx.Tx, courseID string) ([]string, error) {
+	var course Course
+	if err := tx.GetContext(ctx, &course, "SELECT * FROM `courses` WHERE `id` = ? FOR UPDATE", courseID); err != nil {
+		return nil, err
+	}
+	if course.Status != StatusRegistration {
+		return nil, nil
+	}
+
+	var registered int
+	if err := tx.GetContext(ctx, &registered, "SELECT COUNT(*) FROM `registrations` WHERE `course_id` = ?", courseID); err != nil {
+		return nil, err
+	}
+
+	type waiting struct {
+		ID     string `db:"id"`
+		UserID string `db:"user_id"`
+	}
+	var queue []waiting
+	if err := tx.SelectContext(ctx, &queue, "SELECT `id`, `user_id` FROM `waitlists` WHERE `course_id` = ? ORDER BY `id`", courseID); err != nil {
+		return nil, err
+	}
+
+	var promoted []string
+	for _, w := range queue {
+		if course.Capacity != nil && registered >= *course.Capacity {
+			break
+		}
+
+		var conflicts int
+		query := "SELECT COUNT(*)" +
+			" FROM `registrations`" +
+			" JOIN `courses` ON `courses`.`id` = `registrations`.`course_id`" +
+			" WHERE `registrations`.`user_id` = ? AND `courses`.`status` != ? AND `courses`.`period` = ? AND `courses`.`day_of_week` = ?" +
+			" AND `courses`.`term_id` IS NOT DISTINCT FROM ?"
+		if err := tx.GetContext(ctx, &conflicts, query, w.UserID, StatusClosed, course.Period, course.DayOfWeek, course.TermID); err != nil {
+			return nil, err
+		}
+		if conflicts > 0 {
+			continue
+		}
+		missing, err := checkPrerequisites(ctx, tx, w.UserID, []string{courseID})
+		if err != nil {
+			return nil, err
+		}
+		if len(missing) > 0 {
+			continue
+		}
+		var registeredCourses []Course
+		query = "SELECT `courses`.*" +
+			" FROM `courses`" +
+			" JOIN `registrations` ON `courses`.`id` = `registrations`.`course_id`" +
+			" WHERE `courses`.`status` != ? AND `registrations`.`user_id` = ?"
+		if err := tx.SelectContext(ctx, &registeredCourses, query, StatusClosed, w.UserID); err != nil {
+			return nil, err
+		}
+		if len(checkCreditLimit(registeredCourses, []Course{course})) > 0 {
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT INTO `registrations` (`course_id`, `user_id`) VALUES (?, ?) ON CONFLICT(course_id, user_id) DO NOTHING", courseID, w.UserID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM `waitlists` WHERE `id` = ?", w.ID); err != nil {
+			return nil, err
+		}
+
+		announcementID := newULID()
+		if _, err := tx.ExecContext(ctx, "INSERT INTO `announcements` (`id`, `course_id`, `title`, `message`, `target_user_id`) VALUES (?, ?, ?, ?, ?)",
+			announcementID, courseID,
+			fmt.Sprintf("履修登録完了: %v", course.Name),
+			fmt.Sprintf("キャンセル待ちをしていた科目「%v」に空きが出たため、履修登録が完了しました。", course.Name),
+			w.UserID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO `unread_announcements` (`announcement_id`, `user_id`) VALUES (?, ?)", announcementID, w.UserID); err != nil {
+			return nil, err
+		}
+
+		registered++
+		promoted = append(promoted, w.UserID)
+	}
+
+	return promoted, nil
+}
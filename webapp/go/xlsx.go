@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// readXLSX XLSXファイルの最初のシートのセルの値を行毎に読む。
+// 成績表の取り込みに必要な文字列と数値のセルのみ扱い、書式や数式は解釈しない
+func readXLSX(data []byte) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var sharedStrings []string
+	if f, ok := files["xl/sharedStrings.xml"]; ok {
+		var sst struct {
+			Items []xlsxRichText `xml:"si"`
+		}
+		if err := decodeXLSXPart(f, &sst); err != nil {
+			return nil, err
+		}
+		for _, item := range sst.Items {
+			sharedStrings = append(sharedStrings, item.String())
+		}
+	}
+
+	sheetPath, err := firstXLSXSheetPath(files)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := files[sheetPath]
+	if !ok {
+		return nil, errors.New("xlsx: worksheet not found")
+	}
+	var sheet struct {
+		Rows []struct {
+			Cells []struct {
+				Ref    string       `xml:"r,attr"`
+				Type   string       `xml:"t,attr"`
+				Value  string       `xml:"v"`
+				Inline xlsxRichText `xml:"is"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := decodeXLSXPart(f, &sheet); err != nil {
+		return nil, err
+	}
+
+	rows := make([][]string, 0, len(sheet.Rows))
+	for _, r := range sheet.Rows {
+		var row []string
+		for i, cell := range r.Cells {
+			col := xlsxColumnIndex(cell.Ref)
+			if col < 0 {
+				col = max(i, len(row))
+			}
+			for len(row) <= col {
+				row = append(row, "")
+			}
+			switch cell.Type {
+			case "s":
+				idx, err := strconv.Atoi(cell.Value)
+				if err != nil || idx < 0 || idx >= len(sharedStrings) {
+					return nil, errors.New("xlsx: invalid shared string index")
+				}
+				row[col] = sharedStrings[idx]
+			case "inlineStr":
+				row[col] = cell.Inline.String()
+			default:
+				row[col] = cell.Value
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+type xlsxRichText struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxRichText) String() string {
+	if len(t.Runs) == 0 {
+		return t.Text
+	}
+	var sb strings.Builder
+	for _, r := range t.Runs {
+		sb.WriteString(r.Text)
+	}
+	return sb.String()
+}
+
+// firstXLSXSheetPath workbook.xml の最初のシートのパスをリレーションから求める
+func firstXLSXSheetPath(files map[string]*zip.File) (string, error) {
+	const fallback = "xl/worksheets/sheet1.xml"
+	wb, ok := files["xl/workbook.xml"]
+	rels, relsOK := files["xl/_rels/workbook.xml.rels"]
+	if !ok || !relsOK {
+		return fallback, nil
+	}
+
+	var workbook struct {
+		Sheets []struct {
+			RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := decodeXLSXPart(wb, &workbook); err != nil {
+		return "", err
+	}
+	var relationships struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := decodeXLSXPart(rels, &relationships); err != nil {
+		return "", err
+	}
+	if len(workbook.Sheets) == 0 {
+		return "", errors.New("xlsx: no worksheet")
+	}
+	for _, rel := range relationships.Relationships {
+		if rel.ID != workbook.Sheets[0].RelID {
+			continue
+		}
+		if strings.HasPrefix(rel.Target, "/") {
+			return strings.TrimPrefix(rel.Target, "/"), nil
+		}
+		return path.Join("xl", rel.Target), nil
+	}
+	return fallback, nil
+}
+
+func decodeXLSXPart(f *zip.File, v interface{}) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return xml.NewDecoder(io.LimitReader(r, 64<<20)).Decode(v)
+}
+
+// xlsxColumnIndex "AB12" のようなセル参照の列を0始まりの番号にする
+func xlsxColumnIndex(ref string) int {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A'+1)
+	}
+	return col - 1
+}
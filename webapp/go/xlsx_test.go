@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func buildXLSX(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const xlsxTestSharedStrings = `<?xml version="1.0" encoding="UTF-8"?>
+<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<si><t>user_code</t></si>
+<si><t>1</t></si>
+<si><r><t>S</t></r><r><t>001</t></r></si>
+</sst>`
+
+const xlsxTestSheet = `<?xml version="1.0" encoding="UTF-8"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c></row>
+<row r="2"><c r="A2" t="s"><v>2</v></c><c r="C2"><v>85</v></c></row>
+<row r="3"><c r="A3" t="inlineStr"><is><t>S002</t></is></c><c r="B3"><v>70</v></c></row>
+</sheetData>
+</worksheet>`
+
+func TestReadXLSX(t *testing.T) {
+	want := [][]string{
+		{"user_code", "1"},
+		{"S001", "", "85"},
+		{"S002", "70"},
+	}
+
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{
+			name: "default sheet path",
+			files: map[string]string{
+				"xl/sharedStrings.xml":     xlsxTestSharedStrings,
+				"xl/worksheets/sheet1.xml": xlsxTestSheet,
+			},
+		},
+		{
+			name: "sheet path from workbook relationships",
+			files: map[string]string{
+				"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Grades" sheetId="1" r:id="rId2"/></sheets></workbook>`,
+				"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Target="worksheets/grades.xml"/></Relationships>`,
+				"xl/sharedStrings.xml":     xlsxTestSharedStrings,
+				"xl/worksheets/sheet1.xml": `<worksheet><sheetData/></worksheet>`,
+				"xl/worksheets/grades.xml": xlsxTestSheet,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := readXLSX(buildXLSX(t, tt.files))
+			if err != nil {
+				t.Fatalf("readXLSX returned error: %v", err)
+			}
+			if !reflect.DeepEqual(rows, want) {
+				t.Errorf("readXLSX = %q, want %q", rows, want)
+			}
+		})
+	}
+}
+
+func TestReadXLSXInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data func(t *testing.T) []byte
+	}{
+		{
+			name: "not a zip file",
+			data: func(*testing.T) []byte { return []byte("user_code,1\nS001,85\n") },
+		},
+		{
+			name: "no worksheet",
+			data: func(t *testing.T) []byte {
+				return buildXLSX(t, map[string]string{"xl/sharedStrings.xml": xlsxTestSharedStrings})
+			},
+		},
+		{
+			name: "shared string index out of range",
+			data: func(t *testing.T) []byte {
+				return buildXLSX(t, map[string]string{
+					"xl/sharedStrings.xml":     xlsxTestSharedStrings,
+					"xl/worksheets/sheet1.xml": `<worksheet><sheetData><row><c r="A1" t="s"><v>3</v></c></row></sheetData></worksheet>`,
+				})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readXLSX(tt.data(t)); err == nil {
+				t.Error("readXLSX returned no error")
+			}
+		})
+	}
+}
+
+func TestXLSXColumnIndex(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want int
+	}{
+		{"A1", 0},
+		{"C12", 2},
+		{"Z3", 25},
+		{"AA1", 26},
+		{"AB12", 27},
+		{"", -1},
+		{"12", -1},
+	}
+	for _, tt := range tests {
+		if got := xlsxColumnIndex(tt.ref); got != tt.want {
+			t.Errorf("xlsxColumnIndex(%q) = %d, want %d", tt.ref, got, tt.want)
+		}
+	}
+}
@@ -1,12 +1,28 @@
 -- Dropping tables in reverse order of creation
+DROP TABLE IF EXISTS course_prerequisites;
+DROP TABLE IF EXISTS waitlists;
+DROP TABLE IF EXISTS course_status_history;
+DROP TABLE IF EXISTS course_teachers;
+DROP TABLE IF EXISTS course_grants;
 DROP TABLE IF EXISTS unread_announcements;
 DROP TABLE IF EXISTS announcements;
+DROP TABLE IF EXISTS criterion_scores;
+DROP TABLE IF EXISTS rubric_criteria;
+DROP TABLE IF EXISTS submission_similarities;
+DROP TABLE IF EXISTS similarity_analyses;
+DROP TABLE IF EXISTS submission_versions;
 DROP TABLE IF EXISTS submissions;
 DROP TABLE IF EXISTS classes;
 DROP TABLE IF EXISTS registrations;
 DROP TABLE IF EXISTS courses;
+DROP TABLE IF EXISTS grading_scale_grades;
+DROP TABLE IF EXISTS grading_scales;
+DROP TABLE IF EXISTS terms;
 DROP TABLE IF EXISTS users;
 
+-- 科目検索の部分一致(日本語を含む)に使う
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 -- master data
 -- 初手で外部キー制約を外す
 CREATE TABLE users
@@ -15,9 +31,50 @@ CREATE TABLE users
     code            TEXT UNIQUE NOT NULL,
     name            TEXT NOT NULL,
     hashed_password BYTEA NOT NULL,
-    type            TEXT CHECK (type IN ('student', 'teacher')) NOT NULL
+    type            TEXT CHECK (type IN ('student', 'teaching-assistant', 'teacher', 'department-admin')) NOT NULL
+);
+
+CREATE TABLE terms
+(
+    id        TEXT PRIMARY KEY,
+    name      TEXT NOT NULL,
+    starts_on DATE NOT NULL,
+    ends_on   DATE NOT NULL,
+    CHECK (starts_on <= ends_on)
+);
+
+-- 成績評価の尺度。科目で指定しない場合は is_default の尺度 (大学全体の既定) を使う
+CREATE TABLE grading_scales
+(
+    id         TEXT PRIMARY KEY,
+    name       TEXT NOT NULL,
+    is_default BOOLEAN NOT NULL DEFAULT false
 );
 
+create unique index grading_scales_is_default_index
+    on isucholar.grading_scales (is_default) where is_default;
+
+-- 科目の得点率(合計点 / (講義数 x 100点))がmin_score%以上の評語のうち最も高いものになる
+CREATE TABLE grading_scale_grades
+(
+    scale_id    TEXT NOT NULL,
+    letter      TEXT NOT NULL,
+    min_score   SMALLINT CHECK (min_score BETWEEN 0 AND 100) NOT NULL,
+    grade_point DOUBLE PRECISION CHECK (grade_point >= 0) NOT NULL,
+    passing     BOOLEAN NOT NULL, -- 合否判定の科目で合格とするか
+    PRIMARY KEY (scale_id, letter),
+    UNIQUE (scale_id, min_score)
+);
+
+INSERT INTO grading_scales (id, name, is_default)
+VALUES ('default', 'S/A/B/C/F', true);
+INSERT INTO grading_scale_grades (scale_id, letter, min_score, grade_point, passing)
+VALUES ('default', 'S', 90, 4, true),
+       ('default', 'A', 80, 3, true),
+       ('default', 'B', 70, 2, true),
+       ('default', 'C', 60, 1, true),
+       ('default', 'F', 0, 0, false);
+
 CREATE TABLE courses
 (
     id          TEXT PRIMARY KEY,
@@ -30,7 +87,13 @@ CREATE TABLE courses
     day_of_week TEXT CHECK (day_of_week IN ('monday', 'tuesday', 'wednesday', 'thursday', 'friday')) NOT NULL,
     teacher_id  TEXT NOT NULL,
     keywords    TEXT NOT NULL,
-    status      TEXT CHECK (status IN ('registration', 'in-progress', 'closed')) NOT NULL DEFAULT 'registration'
+    status      TEXT CHECK (status IN ('registration', 'in-progress', 'closed')) NOT NULL DEFAULT 'registration',
+    capacity    INTEGER CHECK (capacity > 0), -- NULLは定員なし
+    term_id     TEXT, -- NULLは学期未設定
+    version     INTEGER NOT NULL DEFAULT 1, -- 更新の度に増やす (ETag)
+    archived_at TIMESTAMP, -- NULLでない場合はアーカイブ済み (検索に表示しない)
+    grading_scale_id TEXT, -- NULLは既定の成績評価の尺度
+    pass_fail   BOOLEAN NOT NULL DEFAULT false -- 合否判定のみの科目はGPAの計算に含めない
 --    CONSTRAINT fk_courses_teacher_id FOREIGN KEY (teacher_id) REFERENCES users (id)
 );
 
@@ -51,6 +114,12 @@ CREATE TABLE classes
     title             TEXT NOT NULL,
     description       TEXT NOT NULL,
     submission_closed BOOLEAN NOT NULL DEFAULT false,
+    due_at               TIMESTAMPTZ, -- NULLは締切なし
+    late_policy          TEXT CHECK (late_policy IN ('reject', 'accept', 'penalty')) NOT NULL DEFAULT 'reject',
+    late_penalty_per_day SMALLINT NOT NULL DEFAULT 0 CHECK (late_penalty_per_day BETWEEN 0 AND 100),
+    late_days            SMALLINT NOT NULL DEFAULT 0 CHECK (late_days >= 0), -- 締切後に提出を受け付ける日数 (reject以外)
+    allowed_types        TEXT NOT NULL DEFAULT 'application/pdf', -- 提出を受け付けるMIMEタイプ(カンマ区切り)
+    closed_manually      BOOLEAN NOT NULL DEFAULT false, -- 教員が締切前に提出を締め切った (締切の変更で再開しない)
     UNIQUE (course_id, part)
 --    CONSTRAINT fk_classes_course_id FOREIGN KEY (course_id) REFERENCES courses (id)
 );
@@ -61,17 +130,77 @@ CREATE TABLE submissions
     class_id  TEXT NOT NULL,
     file_name TEXT NOT NULL,
     score     SMALLINT,
+    late      BOOLEAN NOT NULL DEFAULT false,
+    penalty   SMALLINT NOT NULL DEFAULT 0, -- 遅延提出による減点 (scoreは減点後の点数)
+    feedback  TEXT NOT NULL DEFAULT '', -- 採点時の教員からのコメント
     PRIMARY KEY (user_id, class_id)
 --    CONSTRAINT fk_submissions_user_id FOREIGN KEY (user_id) REFERENCES users (id),
 --    CONSTRAINT fk_submissions_class_id FOREIGN KEY (class_id) REFERENCES classes (id)
 );
 
+-- 提出ファイルの履歴。submissionsは最新の提出と採点結果を持つ
+CREATE TABLE submission_versions
+(
+    id           TEXT PRIMARY KEY,
+    user_id      TEXT NOT NULL,
+    class_id     TEXT NOT NULL,
+    version      INTEGER NOT NULL,
+    file_name    TEXT NOT NULL, -- アップロード時のファイル名
+    content_type TEXT NOT NULL DEFAULT 'application/pdf', -- ファイルの内容から判定したMIMEタイプ
+    size         BIGINT, -- 移行前の提出はNULL
+    sha256       TEXT, -- 移行前の提出はNULL
+    storage_key  TEXT NOT NULL, -- BlobStoreのキー
+    late         BOOLEAN NOT NULL DEFAULT false,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (class_id, user_id, version)
+);
+
+-- 講義ごとの提出ファイルの類似度分析の結果。類似度がしきい値以上の組のみ保存する
+CREATE TABLE similarity_analyses
+(
+    class_id    TEXT PRIMARY KEY,
+    analyzed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    submissions INTEGER NOT NULL -- 比較した提出の数
+);
+
+CREATE TABLE submission_similarities
+(
+    class_id     TEXT NOT NULL,
+    version_id_a TEXT NOT NULL,
+    version_id_b TEXT NOT NULL,
+    identical    BOOLEAN NOT NULL, -- ファイルのSHA-256が一致
+    score        DOUBLE PRECISION NOT NULL, -- 抽出したテキストのshingleのJaccard係数
+    PRIMARY KEY (class_id, version_id_a, version_id_b)
+);
+
+-- 講義の採点基準。scoreは各基準の得点の合計を100点満点に換算したもの
+CREATE TABLE rubric_criteria
+(
+    id          TEXT PRIMARY KEY,
+    class_id    TEXT NOT NULL,
+    position    SMALLINT NOT NULL,
+    title       TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    max_points  SMALLINT NOT NULL CHECK (max_points > 0),
+    UNIQUE (class_id, position)
+);
+
+CREATE TABLE criterion_scores
+(
+    user_id      TEXT NOT NULL,
+    criterion_id TEXT NOT NULL,
+    class_id     TEXT NOT NULL,
+    points       SMALLINT NOT NULL,
+    PRIMARY KEY (user_id, criterion_id)
+);
+
 CREATE TABLE announcements
 (
-    id        TEXT PRIMARY KEY,
-    course_id TEXT NOT NULL,
-    title     TEXT NOT NULL,
-    message   TEXT NOT NULL
+    id             TEXT PRIMARY KEY,
+    course_id      TEXT NOT NULL,
+    title          TEXT NOT NULL,
+    message        TEXT NOT NULL,
+    target_user_id TEXT -- NULLは履修者全員宛て
 --    CONSTRAINT fk_announcements_course_id FOREIGN KEY (course_id) REFERENCES courses (id)
 );
 
@@ -85,13 +214,82 @@ CREATE TABLE unread_announcements
 --    CONSTRAINT fk_unread_announcements_user_id FOREIGN KEY (user_id) REFERENCES users (id)
 );
 
+-- 科目毎に付与される権限 (TAなど)
+CREATE TABLE course_grants
+(
+    course_id TEXT NOT NULL,
+    user_id   TEXT NOT NULL,
+    role      TEXT CHECK (role IN ('teaching-assistant')) NOT NULL,
+    PRIMARY KEY (course_id, user_id)
+);
+
+-- 科目の共同担当教員 (担当教員本人はcourses.teacher_id)
+CREATE TABLE course_teachers
+(
+    course_id TEXT NOT NULL,
+    user_id   TEXT NOT NULL,
+    PRIMARY KEY (course_id, user_id)
+);
+
+CREATE TABLE course_status_history
+(
+    id          TEXT PRIMARY KEY,
+    course_id   TEXT NOT NULL,
+    from_status TEXT NOT NULL,
+    to_status   TEXT NOT NULL,
+    changed_by  TEXT NOT NULL,
+    changed_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+create index course_status_history_course_id_index
+    on isucholar.course_status_history (course_id);
+
+-- 定員超過時のキャンセル待ち。idの昇順に繰り上げる
+CREATE TABLE waitlists
+(
+    id        TEXT PRIMARY KEY,
+    course_id TEXT NOT NULL,
+    user_id   TEXT NOT NULL,
+    UNIQUE (course_id, user_id)
+);
+
+-- course_idの履修にはrequired_course_idを合計min_score点以上で修了している必要がある
+CREATE TABLE course_prerequisites
+(
+    course_id          TEXT NOT NULL,
+    required_course_id TEXT NOT NULL,
+    min_score          INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (course_id, required_course_id)
+);
+
 create index announcements_course_id_index
     on isucholar.announcements (course_id);
 
+-- 科目検索 (SearchCourses の courseSearchDocument と同じ式であること)
+create index courses_search_tsvector_index
+    on isucholar.courses using gin (to_tsvector('simple', name || ' ' || description || ' ' || keywords));
+create index courses_search_trgm_index
+    on isucholar.courses using gin ((name || ' ' || description || ' ' || keywords) gin_trgm_ops);
+create index users_name_trgm_index
+    on isucholar.users using gin (name gin_trgm_ops);
+
 ALTER TABLE announcements SET UNLOGGED;
 ALTER TABLE classes SET UNLOGGED;
+ALTER TABLE course_grants SET UNLOGGED;
+ALTER TABLE course_prerequisites SET UNLOGGED;
+ALTER TABLE course_status_history SET UNLOGGED;
+ALTER TABLE course_teachers SET UNLOGGED;
 ALTER TABLE courses SET UNLOGGED;
+ALTER TABLE criterion_scores SET UNLOGGED;
+ALTER TABLE grading_scale_grades SET UNLOGGED;
+ALTER TABLE grading_scales SET UNLOGGED;
 ALTER TABLE registrations SET UNLOGGED;
+ALTER TABLE rubric_criteria SET UNLOGGED;
+ALTER TABLE similarity_analyses SET UNLOGGED;
+ALTER TABLE submission_similarities SET UNLOGGED;
+ALTER TABLE submission_versions SET UNLOGGED;
 ALTER TABLE submissions SET UNLOGGED;
+ALTER TABLE terms SET UNLOGGED;
 ALTER TABLE unread_announcements SET UNLOGGED;
 ALTER TABLE users SET UNLOGGED;
+ALTER TABLE waitlists SET UNLOGGED;
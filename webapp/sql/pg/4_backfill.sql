@@ -0,0 +1,15 @@
+-- submission_versions 導入前の提出を最初のバージョンとして登録する
+-- ファイルは <class_id>-<user_id>.pdf に置かれている。採点結果のみ登録された提出(file_nameが空)はファイルがないので対象外
+INSERT INTO submission_versions (id, user_id, class_id, version, file_name, storage_key)
+SELECT 'legacy-' || submissions.class_id || '-' || submissions.user_id,
+       submissions.user_id,
+       submissions.class_id,
+       1,
+       submissions.file_name,
+       submissions.class_id || '-' || submissions.user_id || '.pdf'
+FROM submissions
+WHERE submissions.file_name != ''
+  AND NOT EXISTS(SELECT 1
+                 FROM submission_versions
+                 WHERE submission_versions.class_id = submissions.class_id
+                   AND submission_versions.user_id = submissions.user_id);